@@ -2,16 +2,22 @@ package hermes
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
+	"sort"
+	"strings"
 )
 
 var (
 	// ADMPath requires the registration url to be injected
 	ADMPath = "/messaging/registrations/%s/messages"
+	// ErrADMChecksum means the md5 adm computed over the data it
+	// received isn't the one sent.
+	ErrADMChecksum = fmt.Errorf("adm checksum mismatch")
 )
 
 // ADMURLs map environment to adm url.
@@ -28,8 +34,12 @@ var ADMURLs = map[string]string{
 type ADMMessage struct {
 	Data             map[string]string `json:"data"`
 	ConsolidationKey string            `json:"consolidationKey"`
-	Expires          int               `json:"expiresAfter"`
-	RegistrationID   string            `json:"-"`
+	// Expires is the seconds adm keeps the message, its default of a
+	// week if 0.
+	Expires int `json:"expiresAfter,omitempty"`
+	// MD5 is the ADMChecksum of Data, set by Send if empty.
+	MD5            string `json:"md5,omitempty"`
+	RegistrationID string `json:"-"`
 }
 
 // Bytes implements interface Message.
@@ -45,6 +55,47 @@ func NewADMMessage(id string) *ADMMessage {
 	}
 }
 
+// ADMChecksum returns the base64 encoded md5 of the data as adm
+// computes it, over the key:value pairs sorted by key joined by commas.
+func ADMChecksum(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + ":" + data[k]
+	}
+	sum := md5.Sum([]byte(strings.Join(pairs, ",")))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ADMError is a message adm rejected for Reason, sending it again
+// fails the same way.
+type ADMError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *ADMError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("adm %d", e.StatusCode)
+	}
+	return fmt.Sprintf("adm %d %s", e.StatusCode, e.Reason)
+}
+
+// admReasonError returns the error of a rejected message.
+func admReasonError(status int, reason string) error {
+	switch {
+	case reason == "InvalidRegistrationId", reason == "Unregistered":
+		return ErrRemoveToken
+	case reason == "AccessTokenExpired", status == 401:
+		return ErrTokenExpired
+	}
+	return &ADMError{StatusCode: status, Reason: reason}
+}
+
 // ADMResponse https://developer.amazon.com/public/apis/engage/device-messaging/tech-docs/06-sending-a-message
 type ADMResponse struct {
 	StatusCode int   `json:"statusCode"`
@@ -99,7 +150,7 @@ func (a *ADMResponse) UpdateToken() bool {
 	if a == nil {
 		return false
 	}
-	if a.Error == ErrRemoveToken || a.Error == ErrUpdateToken {
+	if isTokenError(a.Error) {
 		return true
 	}
 	return false
@@ -107,9 +158,18 @@ func (a *ADMResponse) UpdateToken() bool {
 
 // ADMClient ...
 type ADMClient struct {
-	Key  string
-	http *http.Client
-	url  string
+	// Key is the access token, used when Token is nil.
+	Key string
+	// Token gets and refreshes access tokens, see NewADMTokenClient.
+	Token *ADMToken
+	// RetryPolicy sets the backoff when the service gives no
+	// Retry-After, nil uses DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+	// Tokens is updated with the canonical and unregistered ids of
+	// each send if set.
+	Tokens TokenStore
+	http   *http.Client
+	url    string
 }
 
 // NewADMClient ...
@@ -124,20 +184,57 @@ func NewADMClient(url, key string) (*ADMClient, error) {
 	}, nil
 }
 
+// NewADMTokenClient returns a client requesting and refreshing its
+// access tokens with the security profile's client credentials.
+func NewADMTokenClient(url, clientID, clientSecret string) (*ADMClient, error) {
+	token, err := NewADMToken(clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewADMClient(url, "")
+	if err != nil {
+		return nil, err
+	}
+	c.Token = token
+	return c, nil
+}
+
 // Send ...
 func (c *ADMClient) Send(m *ADMMessage) (*ADMResponse, error) {
+	if m.MD5 == "" {
+		sum := *m
+		sum.MD5 = ADMChecksum(m.Data)
+		m = &sum
+	}
+	ret, err := c.send(m)
+	if err == ErrTokenExpired && c.Token != nil {
+		c.Token.expire()
+		ret, err = c.send(m)
+	}
+	return ret, err
+}
+
+// send makes a single request.
+func (c *ADMClient) send(m *ADMMessage) (*ADMResponse, error) {
 	j, err := json.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
+	key := c.Key
+	if c.Token != nil {
+		key, err = c.Token.AccessToken()
+		if err != nil {
+			return nil, err
+		}
+	}
 	request, err := http.NewRequest("POST", fmt.Sprintf(c.url+ADMPath, m.RegistrationID), bytes.NewBuffer(j))
 	if err != nil {
 		return nil, err
 	}
-	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Key))
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", key))
 	request.Header.Add("Content-Type", "application/json")
 	request.Header.Add("Accept", "application/json")
-	request.Header.Add("X-Amzn-Type-Version ", "com.amazon.device.messaging.ADMMessage@1.0")
+	request.Header.Add("X-Amzn-Type-Version", "com.amazon.device.messaging.ADMMessage@1.0")
 	request.Header.Add("X-Amzn-Accept-Type", "com.amazon.device.messaging.ADMSendResult@1.0")
 
 	resp, err := c.http.Do(request)
@@ -151,68 +248,44 @@ func (c *ADMClient) Send(m *ADMMessage) (*ADMResponse, error) {
 		return nil, err
 	}
 
-	ret := &ADMResponse{StatusCode: resp.StatusCode}
-	switch resp.StatusCode {
-	case 503, 500:
-		// n/a
-		ret.RetryAfter = 0
-		after := resp.Header.Get("Retry-After")
-		i, err := strconv.Atoi(after)
-		if err != nil {
-			ret.RetryAfter = i
-		}
-		ret.Error = ErrRetry
-	case 429:
-		// MaxRateExceeded
-		ret.RetryAfter = 0
+	ret := &ADMResponse{StatusCode: resp.StatusCode, RetryAfter: -1}
+	switch {
+	case resp.StatusCode == 200:
 		err = json.Unmarshal(body, &ret)
 		if err != nil {
 			return nil, err
 		}
-
-		after := resp.Header.Get("Retry-After")
-		i, err := strconv.Atoi(after)
-		if err != nil {
-			ret.RetryAfter = i
+		if sum := resp.Header.Get("X-Amzn-Data-md5"); sum != "" && sum != m.MD5 {
+			ret.Error = ErrADMChecksum
 		}
+	case resp.StatusCode == 429, resp.StatusCode >= 500:
+		// MaxRateExceeded, 500 and 503 have no reason.
+		json.Unmarshal(body, &ret)
+		ret.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
 		ret.Error = ErrRetry
-	case 413:
-		// MessageTooLarge
-		err = json.Unmarshal(body, &ret)
-		if err != nil {
-			return nil, err
-		}
-	case 401:
-		// AccessTokenExpired
-		err = json.Unmarshal(body, &ret)
-		if err != nil {
-			return nil, err
-		}
-		ret.Error = ErrTokenExpired
-	case 400:
-		err = json.Unmarshal(body, &ret)
-		if err != nil {
-			return nil, err
-		}
-		switch ret.Reason {
-		case "InvalidRegistrationId":
-			ret.Error = ErrRemoveToken
-		}
-	case 200:
-		err = json.Unmarshal(body, &ret)
-		if err != nil {
-			return nil, err
-		}
 	default:
-		after := resp.Header.Get("Retry-After")
-		i, err := strconv.Atoi(after)
-		if err != nil {
-			ret.RetryAfter = i
-		}
-		ret.Error = ErrRetry
+		// 400 InvalidRegistrationId, Unregistered, InvalidData,
+		// InvalidConsolidationKey, InvalidExpiration, InvalidChecksum,
+		// InvalidType, 401 AccessTokenExpired, 413 MessageTooLarge.
+		json.Unmarshal(body, &ret)
+		ret.Error = admReasonError(resp.StatusCode, ret.Reason)
 	}
 	ret.RequestID = resp.Header.Get("X-Amzn-RequestId")
 	ret.MD5 = resp.Header.Get("X-Amzn-Data-md5")
 	ret.StatusCode = resp.StatusCode
+
+	var change []tokenChange
+	switch {
+	case ret.Error == ErrRemoveToken:
+		change = append(change, tokenChange{old: m.RegistrationID})
+	case ret.Error == nil && ret.RegistrationID != "" && ret.RegistrationID != m.RegistrationID:
+		// The canonical id to send to from now on.
+		ret.Error = ErrUpdateToken
+		change = append(change, tokenChange{old: m.RegistrationID, new: ret.RegistrationID})
+	}
+	err = storeTokens(c.Tokens, PlatformADM, change...)
+	if err != nil {
+		ret.Error = err
+	}
 	return ret, ret.Error
 }
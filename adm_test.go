@@ -6,16 +6,23 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
 var ADMServer *httptest.Server
 
+// ADMServer accepts every message, registration id "old" is replaced
+// by "new".
 func init() {
 	ADMServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/messaging/registrations/"), "/messages")
+		if id == "old" {
+			id = "new"
+		}
 		resp := ADMResponse{
-			RegistrationID: "amzn1.adm-registration.v1.Y29tLmFtYXpvbi5EZXZpY2VNZXNzYWdpbmcuYL3FOMUlCWEdpdm5TZ3RWbm9XUT0hN0lrSU1YUlNSVVBpT2pOd0lnWktvUT09",
+			RegistrationID: id,
 			Reason:         "",
 		}
 		j, err := json.Marshal(resp)
@@ -59,3 +66,108 @@ func TestADMSend(t *testing.T) {
 		t.Fatalf("didn't get back 200 got: %+v", r)
 	}
 }
+
+func TestADMChecksum(t *testing.T) {
+	tests := []struct {
+		data map[string]string
+		want string
+	}{
+		{map[string]string{"b": "2", "a": "1"}, "Xvb142mSeo7pSjdDDASyeA=="},
+		{map[string]string{}, "1B2M2Y8AsgTpgAmY7PhCfg=="},
+		{map[string]string{"é": "x", "key2": "value2", "key1": "value1"}, "EvMXYUubEO4hlvNXzT+xuw=="},
+	}
+	for _, test := range tests {
+		if got := ADMChecksum(test.data); got != test.want {
+			t.Errorf("expected %s for %v got %s", test.want, test.data, got)
+		}
+	}
+}
+
+func TestADMSendErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := ADMMessage{}
+		json.NewDecoder(r.Body).Decode(&m)
+		if m.MD5 != ADMChecksum(m.Data) {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"reason":"InvalidChecksum"}`)
+			return
+		}
+		var status int
+		var reason string
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/messaging/registrations/"), "%d-%s", &status, &reason)
+		reason = strings.TrimSuffix(reason, "/messages")
+		switch status {
+		case 200:
+			if reason == "corrupt" {
+				w.Header().Set("X-Amzn-Data-md5", "corrupt")
+			} else {
+				w.Header().Set("X-Amzn-Data-md5", m.MD5)
+			}
+			id := fmt.Sprintf("%d-%s", status, reason)
+			if reason == "canonical" {
+				id = "a"
+			}
+			fmt.Fprintf(w, `{"registrationID":%q}`, id)
+			return
+		case 429, 503:
+			w.Header().Set("Retry-After", "3")
+		}
+		w.WriteHeader(status)
+		if reason != "" {
+			fmt.Fprintf(w, `{"reason":%q}`, reason)
+		}
+	}))
+	defer srv.Close()
+	c, _ := NewADMClient(srv.URL, "abc")
+
+	permanent := func(reason string) func(error) bool {
+		return func(err error) bool {
+			aerr, ok := err.(*ADMError)
+			return ok && aerr.Reason == reason
+		}
+	}
+	is := func(want error) func(error) bool {
+		return func(err error) bool { return err == want }
+	}
+	tests := []struct {
+		id    string
+		ok    func(error) bool
+		retry int
+	}{
+		{"200-ok", is(nil), -1},
+		{"200-corrupt", is(ErrADMChecksum), -1},
+		{"200-canonical", is(ErrUpdateToken), -1},
+		{"400-InvalidRegistrationId", is(ErrRemoveToken), -1},
+		{"400-Unregistered", is(ErrRemoveToken), -1},
+		{"400-InvalidData", permanent("InvalidData"), -1},
+		{"400-InvalidConsolidationKey", permanent("InvalidConsolidationKey"), -1},
+		{"400-InvalidExpiration", permanent("InvalidExpiration"), -1},
+		{"400-InvalidChecksum", permanent("InvalidChecksum"), -1},
+		{"400-InvalidType", permanent("InvalidType"), -1},
+		{"401-AccessTokenExpired", is(ErrTokenExpired), -1},
+		{"413-MessageTooLarge", permanent("MessageTooLarge"), -1},
+		{"413", permanent(""), -1},
+		{"429-MaxRateExceeded", is(ErrRetry), 3},
+		{"500", is(ErrRetry), 1},
+		{"503", is(ErrRetry), 3},
+	}
+	for _, test := range tests {
+		m := NewADMMessage(test.id)
+		m.Data["a"] = "b"
+		resp, err := c.Send(m)
+		if !test.ok(err) || resp.Retry() != test.retry {
+			t.Errorf("unexpected %s response %v %+v", test.id, err, resp)
+		}
+		if resp != nil && resp.UpdateToken() != isTokenError(err) {
+			t.Errorf("unexpected %s update token %v", test.id, resp.UpdateToken())
+		}
+	}
+
+	// A checksum that doesn't match the data is rejected.
+	m := NewADMMessage("200-ok")
+	m.Data["a"] = "b"
+	m.MD5 = ADMChecksum(map[string]string{"a": "c"})
+	if _, err := c.Send(m); !permanent("InvalidChecksum")(err) {
+		t.Fatalf("expected invalid checksum got %v", err)
+	}
+}
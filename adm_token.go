@@ -0,0 +1,48 @@
+package hermes
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// ADMTokenURL is where client credentials are exchanged for access
+// tokens.
+var ADMTokenURL = "https://api.amazon.com/auth/O2/token"
+
+// ADMToken exchanges the security profile's client credentials for
+// access tokens, caching them until shortly before they expire. It is
+// safe for concurrent use.
+type ADMToken struct {
+	ClientID     string
+	ClientSecret string
+	// URL is the token endpoint, ADMTokenURL by default.
+	URL string
+	oauthToken
+}
+
+// NewADMToken ...
+func NewADMToken(clientID, clientSecret string) (*ADMToken, error) {
+	if clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("client id and secret required")
+	}
+	return &ADMToken{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		URL:          ADMTokenURL,
+		oauthToken:   newOAuthToken(),
+	}, nil
+}
+
+// AccessToken returns the cached access token, requesting a new one
+// once it is about to expire.
+func (t *ADMToken) AccessToken() (string, error) {
+	return t.accessToken(t.URL, func(now time.Time) (url.Values, error) {
+		form := url.Values{}
+		form.Set("grant_type", "client_credentials")
+		form.Set("scope", "messaging:push")
+		form.Set("client_id", t.ClientID)
+		form.Set("client_secret", t.ClientSecret)
+		return form, nil
+	})
+}
@@ -0,0 +1,164 @@
+package hermes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// admTokenServer issues access tokens valid for expiresIn seconds to
+// client "id" with secret "secret" and accepts sends with them.
+type admTokenServer struct {
+	*httptest.Server
+	expiresIn int
+
+	mu     sync.Mutex
+	issued int
+	valid  map[string]bool
+}
+
+// ADMTokenServer also serves the token endpoint ADMTokenURL points at.
+var ADMTokenServer *admTokenServer
+
+func init() {
+	s := &admTokenServer{valid: make(map[string]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/O2/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "messaging:push" ||
+			r.Form.Get("client_id") != "id" || r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"error":"invalid_client","error_description":"Client authentication failed"}`)
+			return
+		}
+		s.mu.Lock()
+		s.issued++
+		access := fmt.Sprintf("Atc|%d", s.issued)
+		s.valid[access] = true
+		expiresIn := s.expiresIn
+		s.mu.Unlock()
+		fmt.Fprintf(w, `{"access_token":%q,"expires_in":%d,"scope":"messaging:push","token_type":"bearer"}`, access, expiresIn)
+	})
+	mux.HandleFunc("/messaging/registrations/", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		valid := s.valid[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		s.mu.Unlock()
+		if !valid {
+			w.WriteHeader(401)
+			fmt.Fprintln(w, `{"reason":"AccessTokenExpired"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"registrationID":"amzn1.adm-registration.v1.123"}`)
+	})
+	s.Server = httptest.NewServer(mux)
+	ADMTokenServer = s
+	ADMTokenURL = s.URL + "/auth/O2/token"
+}
+
+// reset forgets the tokens issued, new ones are valid for expiresIn
+// seconds.
+func (s *admTokenServer) reset(expiresIn int) {
+	s.mu.Lock()
+	s.expiresIn = expiresIn
+	s.issued = 0
+	s.valid = make(map[string]bool)
+	s.mu.Unlock()
+}
+
+// revoke invalidates every access token issued so far.
+func (s *admTokenServer) revoke() {
+	s.mu.Lock()
+	s.valid = make(map[string]bool)
+	s.mu.Unlock()
+}
+
+func TestNewADMTokenClient(t *testing.T) {
+	if _, err := NewADMTokenClient(ADMURLs["testing"], "id", ""); err == nil {
+		t.Fatal("expected error without secret")
+	}
+	if _, err := NewADMTokenClient("", "id", "secret"); err == nil {
+		t.Fatal("expected error without url")
+	}
+	c, err := NewADMTokenClient(ADMURLs["testing"], "id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Key != "" || c.Token == nil || c.Token.ClientID != "id" || c.Token.URL != ADMTokenURL {
+		t.Fatalf("unexpected client %+v", c)
+	}
+}
+
+func TestADMTokenSend(t *testing.T) {
+	ADMTokenServer.reset(3600)
+	c, _ := NewADMTokenClient(ADMTokenServer.URL, "id", "secret")
+	m := NewADMMessage("amzn1.adm-registration.v1.123")
+	m.Data["a"] = "b"
+
+	if _, err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if ADMTokenServer.issued != 1 {
+		t.Fatalf("expected the token cached got %d", ADMTokenServer.issued)
+	}
+
+	// An expired token is replaced and the message sent again.
+	ADMTokenServer.revoke()
+	if _, err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if ADMTokenServer.issued != 2 {
+		t.Fatalf("expected a new token got %d", ADMTokenServer.issued)
+	}
+
+	c, _ = NewADMTokenClient(ADMTokenServer.URL, "id", "wrong")
+	if _, err := c.Send(m); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Fatalf("expected token request error got %v", err)
+	}
+}
+
+func TestADMTokenRefresh(t *testing.T) {
+	// Expiring within the leeway, every send gets a new token.
+	ADMTokenServer.reset(30)
+	c, _ := NewADMTokenClient(ADMTokenServer.URL, "id", "secret")
+	m := NewADMMessage("amzn1.adm-registration.v1.123")
+	for i := 0; i < 3; i++ {
+		if _, err := c.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ADMTokenServer.issued != 3 {
+		t.Fatalf("expected the token refreshed before expiry got %d", ADMTokenServer.issued)
+	}
+}
+
+func TestADMTokenConcurrentSend(t *testing.T) {
+	ADMTokenServer.reset(3600)
+	c, _ := NewADMTokenClient(ADMTokenServer.URL, "id", "secret")
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Send(NewADMMessage("amzn1.adm-registration.v1.123"))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ADMTokenServer.issued != 1 {
+		t.Fatalf("expected a single token got %d", ADMTokenServer.issued)
+	}
+}
@@ -8,8 +8,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,9 +18,27 @@ const (
 	// maxPoolSize is the number of sockets to open per
 	// app.
 	maxPoolSize = 20
+	// apnsSentBufferSize is the number of sent notifications each
+	// connection keeps to resend after apple rejects one of them.
+	apnsSentBufferSize = 1000
 )
 
+// Item ids of the command 2 frame.
+const (
+	apnsItemDeviceToken = 1
+	apnsItemPayload     = 2
+	apnsItemIdentifier  = 3
+	apnsItemExpiration  = 4
+	apnsItemPriority    = 5
+)
+
+// apnsIdentifier is incremented for every notification so identifiers
+// in a connection's sent buffer don't collide.
+var apnsIdentifier int32
+
 var (
+	// APNSReadTimeout is no longer used, errors are read in the background
+	// and reported to APNSClient.OnError.
 	APNSReadTimeout = 150
 	// APNSURLs map environment to gateway.
 	APNSURLs = map[string]string{
@@ -46,12 +65,47 @@ var (
 	}
 )
 
-// APNSMessage alert is an interface here because it supports either a string
-// or a dictionary, represented within by an AlertDictionary struct.
+// Interruption levels of an APNSMessage.
+const (
+	APNSInterruptionPassive       = "passive"
+	APNSInterruptionActive        = "active"
+	APNSInterruptionTimeSensitive = "time-sensitive"
+	APNSInterruptionCritical      = "critical"
+)
+
+// APNSMessage is the aps dictionary. Alert is an interface here because it
+// supports either a string or a dictionary, represented within by an
+// AlertDictionary struct. Sound is either a string or an APNSSound.
 type APNSMessage struct {
 	Alert interface{} `json:"alert,omitempty"`
 	Badge int         `json:"badge,omitempty"`
-	Sound string      `json:"sound,omitempty"`
+	// ClearBadge sends a badge of 0, which removes the badge.
+	ClearBadge bool        `json:"-"`
+	Sound      interface{} `json:"sound,omitempty"`
+	// ContentAvailable set to 1 for a silent background update.
+	ContentAvailable int `json:"content-available,omitempty"`
+	// MutableContent set to 1 lets a notification service extension
+	// modify the notification.
+	MutableContent    int     `json:"mutable-content,omitempty"`
+	Category          string  `json:"category,omitempty"`
+	ThreadID          string  `json:"thread-id,omitempty"`
+	TargetContentID   string  `json:"target-content-id,omitempty"`
+	InterruptionLevel string  `json:"interruption-level,omitempty"`
+	RelevanceScore    float64 `json:"relevance-score,omitempty"`
+	FilterCriteria    string  `json:"filter-criteria,omitempty"`
+}
+
+// MarshalJSON only differs from the default by sending a badge of 0
+// when ClearBadge is set.
+func (a APNSMessage) MarshalJSON() ([]byte, error) {
+	type aps APNSMessage
+	if a.ClearBadge && a.Badge == 0 {
+		return json.Marshal(struct {
+			aps
+			Badge int `json:"badge"`
+		}{aps(a), 0})
+	}
+	return json.Marshal(aps(a))
 }
 
 // Bytes implements interface Message.
@@ -65,7 +119,11 @@ type APNSPushNotification struct {
 	Expiry      uint32
 	DeviceToken string
 	Priority    uint8
-	payload     map[string]interface{}
+	// Topic, CollapseID and PushType are only sent with the http/2 api.
+	Topic      string
+	CollapseID string
+	PushType   string
+	payload    map[string]interface{}
 }
 
 // Bytes implements interface Message.
@@ -80,6 +138,11 @@ type APNSResponse struct {
 	Identifier int32 `json:"identifier"`
 	Error      error `json:"err"`
 	RetryAfter int   `json:"retryAfter"`
+	// StatusCode, Reason, Timestamp and ID are only set by the http/2 api.
+	StatusCode int       `json:"statusCode"`
+	Reason     string    `json:"reason"`
+	Timestamp  time.Time `json:"timestamp"`
+	ID         string    `json:"apnsID"`
 }
 
 // Bytes implements interface Response.
@@ -97,7 +160,7 @@ func (a *APNSResponse) UpdateToken() bool {
 	if a == nil {
 		return false
 	}
-	if a.Error == ErrRemoveToken || a.Error == ErrUpdateToken {
+	if isTokenError(a.Error) {
 		return true
 	}
 	return false
@@ -107,20 +170,52 @@ func (a *APNSResponse) UpdateToken() bool {
 // "Use the ... alert dictionary in general only if you absolutely need to."
 // The AlertDictionary is suitable for specific localization needs.
 type APNSAlertDictionary struct {
-	Body         string   `json:"body,omitempty"`
-	ActionLocKey string   `json:"action-loc-key,omitempty"`
-	LocKey       string   `json:"loc-key,omitempty"`
-	LocArgs      []string `json:"loc-args,omitempty"`
-	LaunchImage  string   `json:"launch-image,omitempty"`
+	Title           string   `json:"title,omitempty"`
+	Subtitle        string   `json:"subtitle,omitempty"`
+	Body            string   `json:"body,omitempty"`
+	LaunchImage     string   `json:"launch-image,omitempty"`
+	TitleLocKey     string   `json:"title-loc-key,omitempty"`
+	TitleLocArgs    []string `json:"title-loc-args,omitempty"`
+	SubtitleLocKey  string   `json:"subtitle-loc-key,omitempty"`
+	SubtitleLocArgs []string `json:"subtitle-loc-args,omitempty"`
+	ActionLocKey    string   `json:"action-loc-key,omitempty"`
+	LocKey          string   `json:"loc-key,omitempty"`
+	LocArgs         []string `json:"loc-args,omitempty"`
+	SummaryArg      string   `json:"summary-arg,omitempty"`
+	SummaryArgCount int      `json:"summary-arg-count,omitempty"`
+}
+
+// APNSSound is the sound dictionary used for critical alerts.
+type APNSSound struct {
+	// Critical set to 1 for a critical alert.
+	Critical int    `json:"critical,omitempty"`
+	Name     string `json:"name"`
+	// Volume between 0 and 1, left out when 0 so apple plays it at
+	// full volume.
+	Volume float64 `json:"volume,omitempty"`
 }
 
+// APNSErrorHandler is called with a notification apple rejected.
+type APNSErrorHandler func(apn *APNSPushNotification, resp *APNSResponse)
+
 // APNSClient ...
 type APNSClient struct {
 	Certificate        string
 	Key                string
 	Gateway            string
+	FeedbackGateway    string
 	Pool               *APNSPool
 	InsecureSkipVerify bool
+	// OnError is called from the connection's reader when apple returns
+	// an error for a notification Send already returned for. Notifications
+	// sent after the failed one are resent automatically.
+	OnError APNSErrorHandler
+	// RetryPolicy sets RetryAfter of retryable errors, nil uses
+	// DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+	// Tokens removes the tokens apple rejects as invalid on send if set.
+	// Feedback leaves it alone, the caller removes the tokens it returns.
+	Tokens TokenStore
 }
 
 // APNSPool ...
@@ -132,32 +227,53 @@ type APNSPool struct {
 // APNSConn ...
 type APNSConn struct {
 	gateway        string
-	readTimeout    time.Duration
 	tlsConn        *tls.Conn
 	tlsCfg         tls.Config
 	transactionID  uint32
 	connected      bool
-	maxPayloadSize int // default to 256 as per Apple specifications (June 9 2012)
+	maxPayloadSize int // APNSMaxPayloadBinary
+
+	// mu guards the connection between Send and the error reader.
+	mu      sync.Mutex
+	sent    *apnsRing
+	onError APNSErrorHandler
 }
 
 // NewAPNSClient ...
 func NewAPNSClient(gateway, cert, key string) (*APNSClient, error) {
-	p, err := newAPNSPool(gateway, cert, key)
+	client := &APNSClient{
+		Gateway:         gateway,
+		FeedbackGateway: feedbackGateway(gateway),
+		Certificate:     cert,
+		Key:             key,
+	}
+	p, err := newAPNSPool(gateway, cert, key, client.handleError)
 	if err != nil {
 		return nil, err
 	}
-	client := &APNSClient{
-		Gateway:     gateway,
-		Certificate: cert,
-		Key:         key,
-		Pool:        p,
-	}
+	client.Pool = p
 
 	return client, err
 }
 
+// handleError passes errors from the connections to OnError.
+func (c *APNSClient) handleError(apn *APNSPushNotification, resp *APNSResponse) {
+	switch resp.Error {
+	case ErrRetry:
+		resp.RetryAfter = c.RetryPolicy.RetryAfter(nil)
+	case ErrRemoveToken:
+		err := storeTokens(c.Tokens, PlatformAPNS, tokenChange{old: apn.DeviceToken})
+		if err != nil {
+			resp.Error = err
+		}
+	}
+	if c.OnError != nil {
+		c.OnError(apn, resp)
+	}
+}
+
 // newAPNSConn is the actual connection to the remote server.
-func newAPNSConn(gateway, cert, key string) (*APNSConn, error) {
+func newAPNSConn(gateway, cert, key string, onError APNSErrorHandler) (*APNSConn, error) {
 	conn := &APNSConn{}
 	crt, err := tls.X509KeyPair([]byte(cert), []byte(key))
 	if err != nil {
@@ -169,20 +285,21 @@ func newAPNSConn(gateway, cert, key string) (*APNSConn, error) {
 		Certificates:       []tls.Certificate{crt},
 	}
 
-	conn.readTimeout = time.Duration(APNSReadTimeout) * time.Millisecond
-	conn.maxPayloadSize = 256
+	conn.maxPayloadSize = APNSMaxPayloadBinary
 	conn.connected = false
 	conn.gateway = gateway
+	conn.sent = newAPNSRing(apnsSentBufferSize)
+	conn.onError = onError
 
 	return conn, nil
 }
 
 // newAPNSPool ...
-func newAPNSPool(gateway, certificate, key string) (*APNSPool, error) {
+func newAPNSPool(gateway, certificate, key string, onError APNSErrorHandler) (*APNSPool, error) {
 	pool := make(chan *APNSConn, maxPoolSize)
 	n := 0
 	for x := 0; x < maxPoolSize; x++ {
-		c, err := newAPNSConn(gateway, certificate, key)
+		c, err := newAPNSConn(gateway, certificate, key, onError)
 		if err != nil {
 			// Possible errors are missing/invalid environment which would be caught earlier.
 			// Most likely invalid cert.
@@ -204,7 +321,7 @@ func NewAPNSPushNotification(deviceToken string, ap *APNSMessage, expiry uint32)
 	*/
 
 	apn := &APNSPushNotification{
-		Identifier:  rand.New(rand.NewSource(time.Now().UnixNano())).Int31n(9999),
+		Identifier:  atomic.AddInt32(&apnsIdentifier, 1),
 		Priority:    10,
 		Expiry:      expiry,
 		DeviceToken: deviceToken,
@@ -227,6 +344,13 @@ func (a *APNSPushNotification) Set(key string, value interface{}) {
 
 // Close ...
 func (c *APNSConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.close()
+}
+
+// close must be called with mu held.
+func (c *APNSConn) close() error {
 	var err error
 	if c.tlsConn != nil {
 		err = c.tlsConn.Close()
@@ -235,14 +359,15 @@ func (c *APNSConn) Close() error {
 	return err
 }
 
-// connect ...
+// connect must be called with mu held. Every new connection gets
+// its own error reader.
 func (c *APNSConn) connect() (err error) {
 	if c.connected {
 		return nil
 	}
 
 	if c.tlsConn != nil {
-		c.Close()
+		c.close()
 	}
 
 	conn, err := net.Dial("tcp", c.gateway)
@@ -252,11 +377,93 @@ func (c *APNSConn) connect() (err error) {
 
 	c.tlsConn = tls.Client(conn, &c.tlsCfg)
 	err = c.tlsConn.Handshake()
-	if err == nil {
-		c.connected = true
+	if err != nil {
+		return err
 	}
+	c.connected = true
+	c.sent.reset()
+	go c.readErrors(c.tlsConn)
 
-	return err
+	return nil
+}
+
+// write must be called with mu held.
+func (c *APNSConn) write(s *apnsSent) error {
+	err := c.connect()
+	if err != nil {
+		return err
+	}
+	_, err = c.tlsConn.Write(s.frame)
+	if err != nil {
+		c.close()
+		return err
+	}
+	c.sent.add(s)
+	return nil
+}
+
+// readErrors waits for the error response apple writes before closing
+// the connection. The rejected notification is reported to onError and
+// everything sent after it is written to a fresh connection.
+func (c *APNSConn) readErrors(conn *tls.Conn) {
+	read := [6]byte{}
+	for {
+		_, err := io.ReadFull(conn, read[:])
+		if err == nil && read[1] == 0 {
+			// 0: "No errors encountered"
+			continue
+		}
+
+		c.mu.Lock()
+		if c.tlsConn != conn {
+			// Replaced by a new connection already.
+			c.mu.Unlock()
+			return
+		}
+		c.close()
+		if err != nil {
+			c.mu.Unlock()
+			return
+		}
+
+		status := uint8(read[1])
+		identifier := int32(binary.BigEndian.Uint32(read[2:]))
+		failed, resend := c.sent.after(identifier)
+
+		var failures []*apnsSent
+		var responses []*APNSResponse
+		if failed != nil && status != 10 {
+			// 10: "Shutdown" carries the last notification sent
+			// successfully, only the ones after it need resending.
+			apr := &APNSResponse{
+				Command:    uint8(read[0]),
+				Status:     status,
+				Identifier: identifier,
+			}
+			apr.RetryAfter, apr.Error = apnsStatusError(status, read[:])
+			failures = append(failures, failed)
+			responses = append(responses, apr)
+		}
+		for _, s := range resend {
+			err = c.write(s)
+			if err != nil {
+				failures = append(failures, s)
+				responses = append(responses, &APNSResponse{
+					Identifier: s.apn.Identifier,
+					RetryAfter: 0,
+					Error:      ErrRetry,
+				})
+			}
+		}
+		c.mu.Unlock()
+
+		if c.onError != nil {
+			for i, s := range failures {
+				c.onError(s.apn, responses[i])
+			}
+		}
+		return
+	}
 }
 
 // Get ...
@@ -269,93 +476,143 @@ func (p *APNSPool) Release(conn *APNSConn) {
 	p.pool <- conn
 }
 
-// Send ...
+// Send writes the notification and returns without waiting for a
+// response, apple only responds on errors. Those are reported to OnError.
 func (c *APNSClient) Send(apn *APNSPushNotification) (*APNSResponse, error) {
 	conn := c.Pool.Get()
 	defer c.Pool.Release(conn)
-	err := conn.connect()
-	if err != nil {
-		return nil, err
-	}
 
-	token, err := hex.DecodeString(apn.DeviceToken)
+	payload, err := apn.validate(conn.maxPayloadSize)
 	if err != nil {
 		return nil, err
 	}
-	payload, err := json.Marshal(apn.payload)
+	token, err := hex.DecodeString(apn.DeviceToken)
 	if err != nil {
 		return nil, err
 	}
-	if len(payload) > 256 {
-		return nil, fmt.Errorf("payload larger than 256, got %d %s", len(payload), payload)
-	}
-	buffer := bytes.NewBuffer([]byte{})
-	binary.Write(buffer, binary.BigEndian, uint8(1))           // command
-	binary.Write(buffer, binary.BigEndian, apn.Identifier)     // transaction id, optional
-	binary.Write(buffer, binary.BigEndian, apn.Expiry)         // expiration time(sec)
-	binary.Write(buffer, binary.BigEndian, uint16(len(token))) // push device token
-	binary.Write(buffer, binary.BigEndian, token)
-	binary.Write(buffer, binary.BigEndian, uint16(len(payload))) // payload
-	binary.Write(buffer, binary.BigEndian, payload)
+	frame := apnsFrame(apn, token, payload)
 
 	apr := &APNSResponse{
 		Identifier: apn.Identifier,
 		RetryAfter: -1,
 	}
 
-	_, err = conn.tlsConn.Write(buffer.Bytes())
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	err = conn.connect()
+	if err != nil {
+		return nil, err
+	}
+	err = conn.write(&apnsSent{apn: apn, frame: frame})
 	if err != nil {
-		conn.connected = false
-		apr.RetryAfter = 5
+		apr.RetryAfter = c.RetryPolicy.RetryAfter(nil)
 		apr.Error = ErrRetry
 		return apr, apr.Error
 	}
-	conn.tlsConn.SetReadDeadline(time.Now().Add(conn.readTimeout))
-	read := [6]byte{}
-	n, err := conn.tlsConn.Read(read[:])
-	if err != nil {
-		if err2, ok := err.(net.Error); ok && err2.Timeout() {
-			// Success, apns doesn't usually return a response if successful.
-			// Only issue is, is timeout length long enough (150ms) for err response.
-			return apr, nil
+
+	return apr, nil
+}
+
+// apnsFrame encodes the notification with command 2, a frame of items
+// each prefixed with its item id and length.
+func apnsFrame(apn *APNSPushNotification, token, payload []byte) []byte {
+	items := bytes.NewBuffer([]byte{})
+	item := func(id uint8, data interface{}) {
+		binary.Write(items, binary.BigEndian, id)
+		binary.Write(items, binary.BigEndian, uint16(binary.Size(data)))
+		binary.Write(items, binary.BigEndian, data)
+	}
+	item(apnsItemDeviceToken, token)
+	item(apnsItemPayload, payload)
+	item(apnsItemIdentifier, apn.Identifier)
+	item(apnsItemExpiration, apn.Expiry)
+	item(apnsItemPriority, apn.Priority)
+
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.BigEndian, uint8(2))            // command
+	binary.Write(buffer, binary.BigEndian, uint32(items.Len())) // frame length
+	buffer.Write(items.Bytes())
+	return buffer.Bytes()
+}
+
+// apnsStatusError maps the status of an error response. Retryable
+// errors wait 0 seconds, APNSClient applies its RetryPolicy.
+func apnsStatusError(status uint8, read []byte) (int, error) {
+	switch status {
+	case 1:
+		//1:   "Processing error"
+		return 0, ErrRetry
+	case 2, 3, 4, 6, 7:
+		//2:   "Missing Device Token",
+		//3:   "Missing Topic",
+		//4:   "Missing Payload",
+		//6:   "Invalid Topic Size",
+		//7:   "Invalid Payload Size",
+		return -1, fmt.Errorf("error code:%s %v", APNSStatusCodes[status], hex.EncodeToString(read))
+	case 5, 8:
+		//8:   "Invalid Token",
+		//5:   "Invalid Token Size",
+		return -1, ErrRemoveToken
+	default:
+		return -1, fmt.Errorf("unknown error code %v", hex.EncodeToString(read))
+	}
+}
+
+// apnsSent is a notification and the frame written for it.
+type apnsSent struct {
+	apn   *APNSPushNotification
+	frame []byte
+}
+
+// apnsRing keeps the most recently sent notifications in order.
+type apnsRing struct {
+	items []*apnsSent
+	start int
+	n     int
+}
+
+// newAPNSRing ...
+func newAPNSRing(size int) *apnsRing {
+	return &apnsRing{items: make([]*apnsSent, size)}
+}
+
+// add appends s, dropping the oldest entry when full.
+func (r *apnsRing) add(s *apnsSent) {
+	if r.n < len(r.items) {
+		r.items[(r.start+r.n)%len(r.items)] = s
+		r.n++
+		return
+	}
+	r.items[r.start] = s
+	r.start = (r.start + 1) % len(r.items)
+}
+
+// reset ...
+func (r *apnsRing) reset() {
+	for i := range r.items {
+		r.items[i] = nil
+	}
+	r.start = 0
+	r.n = 0
+}
+
+// after returns the notification with the identifier and the ones sent
+// after it. If it is no longer buffered everything buffered was sent later.
+func (r *apnsRing) after(identifier int32) (*apnsSent, []*apnsSent) {
+	for i := r.n - 1; i >= 0; i-- {
+		s := r.items[(r.start+i)%len(r.items)]
+		if s.apn.Identifier != identifier {
+			continue
 		}
-		if err == io.EOF {
-			conn.connected = false
-			apr.RetryAfter = 5
-			apr.Error = ErrRetry
-			return apr, apr.Error
+		later := make([]*apnsSent, 0, r.n-i-1)
+		for j := i + 1; j < r.n; j++ {
+			later = append(later, r.items[(r.start+j)%len(r.items)])
 		}
-		return nil, err
+		return s, later
 	}
-	if n >= 0 {
-		status := uint8(read[1])
-		apr.Status = status
-		switch status {
-		case 0:
-			return apr, nil
-		case 1:
-			//1:   "Processing error"
-			// err := fmt.Errorf("error code:%s %v", APNSStatusCodes[status], hex.EncodeToString(read[:n]))
-			apr.RetryAfter = 5
-			apr.Error = ErrRetry
-		case 2, 3, 4, 6, 7:
-			//2:   "Missing Device Token",
-			//3:   "Missing Topic",
-			//4:   "Missing Payload",
-			//6:   "Invalid Topic Size",
-			//7:   "Invalid Payload Size",
-			err := fmt.Errorf("error code:%s %v", APNSStatusCodes[status], hex.EncodeToString(read[:n]))
-			apr.Error = err
-		case 5, 8:
-			//8:   "Invalid Token",
-			//5:   "Invalid Token Size",
-			// log.Errorf("error code:%s %v", APNSStatusCodes[status], hex.EncodeToString(read[:n]))
-			apr.Error = ErrRemoveToken
-		default:
-			err := fmt.Errorf("unknown error code %v", hex.EncodeToString(read[:n]))
-			apr.Error = err
-		}
+	all := make([]*apnsSent, 0, r.n)
+	for j := 0; j < r.n; j++ {
+		all = append(all, r.items[(r.start+j)%len(r.items)])
 	}
-
-	return apr, apr.Error
+	return nil, all
 }
@@ -1,52 +1,60 @@
 package hermes
 
 import (
-	"bytes"
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
-	"log"
+	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 // Wait at most this many seconds for feedback data from Apple.
 const feedbackTimeout = 5
 
-// APNSFeedbackChannel will receive individual responses from Apple.
-var APNSFeedbackChannel = make(chan *FeedbackResponse)
-
-// If there's nothing to read, ShutdownChannel gets a true.
-var APNSShutdownChannel = make(chan bool)
+// APNSFeedbackURLs map environment to feedback gateway.
+var APNSFeedbackURLs = map[string]string{
+	"testing":         "localhost:5555",
+	"development":     "feedback.sandbox.push.apple.com:2196",
+	"staging":         "feedback.sandbox.push.apple.com:2196",
+	"staging_sandbox": "feedback.sandbox.push.apple.com:2196",
+	"sandbox":         "feedback.sandbox.push.apple.com:2196",
+	"production":      "feedback.push.apple.com:2196",
+}
 
-// FeedbackResponse ...
+// FeedbackResponse is a device token apple could no longer deliver to.
 type FeedbackResponse struct {
-	Timestamp   uint32
+	// Timestamp is when apple determined the app was removed, the token
+	// should only be removed if it hasn't been registered again since.
+	Timestamp   time.Time
 	TokenLength uint16
 	DeviceToken string
 }
 
-// RunFeedback runs APNS feedback waiting for errors.
-func (a *APNSClient) RunFeedback() error {
-	go a.ListenForFeedback()
-	go func() {
-		for {
-			select {
-			case resp := <-APNSFeedbackChannel:
-				log.Println("- recv'd:", resp.DeviceToken)
-			case <-APNSShutdownChannel:
-				log.Println("- nothing returned from the feedback service")
-			}
+// feedbackGateway returns the feedback gateway for the environment of
+// the push gateway.
+func feedbackGateway(gateway string) string {
+	for env, url := range APNSURLs {
+		if url == gateway {
+			return APNSFeedbackURLs[env]
 		}
-	}()
-	return nil
+	}
+	return ""
 }
 
-// ListenForFeedback connects to the Apple Feedback Service and checks for feedback.
-func (a *APNSClient) ListenForFeedback() (err error) {
+// Feedback connects to the feedback service and returns every
+// token it has for the app. Tokens is left alone, a token may have been
+// registered again after its Timestamp so the caller decides which to
+// remove.
+func (a *APNSClient) Feedback() ([]*FeedbackResponse, error) {
+	if a.FeedbackGateway == "" {
+		return nil, fmt.Errorf("feedback gateway not set")
+	}
 	cert, err := tls.X509KeyPair([]byte(a.Certificate), []byte(a.Key))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	conf := &tls.Config{
@@ -54,45 +62,86 @@ func (a *APNSClient) ListenForFeedback() (err error) {
 		Certificates:       []tls.Certificate{cert},
 	}
 
-	conn, err := net.Dial("tcp", a.Gateway)
+	conn, err := net.Dial("tcp", a.FeedbackGateway)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer conn.Close()
-	conn.SetReadDeadline(time.Now().Add(feedbackTimeout * time.Second))
+	conn.SetDeadline(time.Now().Add(feedbackTimeout * time.Second))
 
 	tlsConn := tls.Client(conn, conf)
 	err = tlsConn.Handshake()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var tokenLength uint16
-	buffer := make([]byte, 38, 38)
-	deviceToken := make([]byte, 32, 32)
+	return ReadFeedback(tlsConn)
+}
 
+// ReadFeedback reads feedback tuples until the service closes the
+// connection or stops sending:
+//
+//	[4 bytes timestamp, 2 bytes token length, token]
+//
+// Tuples read before an error are returned with it.
+func ReadFeedback(r io.Reader) ([]*FeedbackResponse, error) {
+	ret := []*FeedbackResponse{}
+	header := make([]byte, 6)
 	for {
-		_, err := tlsConn.Read(buffer)
+		n, err := io.ReadFull(r, header)
 		if err != nil {
-			APNSShutdownChannel <- true
-			break
+			if n == 0 && (err == io.EOF || isTimeout(err)) {
+				return ret, nil
+			}
+			return ret, err
 		}
 
-		resp := &FeedbackResponse{}
-
-		r := bytes.NewReader(buffer)
-		binary.Read(r, binary.BigEndian, &resp.Timestamp)
-		binary.Read(r, binary.BigEndian, &tokenLength)
-		binary.Read(r, binary.BigEndian, &deviceToken)
-		if tokenLength != 32 {
-			//err := fmt.Errorf("token length should be equal to 32, got %d", tokenLength)
-			continue
+		timestamp := binary.BigEndian.Uint32(header[0:4])
+		tokenLength := binary.BigEndian.Uint16(header[4:6])
+		token := make([]byte, tokenLength)
+		_, err = io.ReadFull(r, token)
+		if err != nil {
+			return ret, err
 		}
-		resp.DeviceToken = hex.EncodeToString(deviceToken)
-		resp.TokenLength = tokenLength
 
-		APNSFeedbackChannel <- resp
+		ret = append(ret, &FeedbackResponse{
+			Timestamp:   time.Unix(int64(timestamp), 0),
+			TokenLength: tokenLength,
+			DeviceToken: hex.EncodeToString(token),
+		})
 	}
+}
+
+// isTimeout ...
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// RunFeedback checks for feedback right away and then every interval,
+// passing the results to fn. Tokens is not updated, fn removes the
+// tokens not registered again since their Timestamp from storage. fn
+// is not called again once stop returns.
+func (a *APNSClient) RunFeedback(interval time.Duration, fn func([]*FeedbackResponse, error)) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			fn(a.Feedback())
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
 
-	return nil
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
 }
@@ -4,48 +4,142 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/binary"
-	"log"
 	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
 	"time"
 )
 
+// feedbackTuple encodes one tuple the way the Apple service does.
+//
+// [4 bytes, 2 bytes, n bytes]
+func feedbackTuple(timestamp uint32, token []byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, timestamp)
+	binary.Write(buf, binary.BigEndian, uint16(len(token)))
+	binary.Write(buf, binary.BigEndian, token)
+	return buf.Bytes()
+}
+
 // This is a simple stand-in for the Apple feedback service that
-// can be used for testing purposes.
-func mockFeedbackServer(cert, key string) {
-	crt, err := tls.LoadX509KeyPair(cert, key)
+// can be used for testing purposes. It writes data in small pieces to
+// every connection then closes it.
+func mockFeedbackServer(t *testing.T, data []byte) net.Listener {
+	crt, err := tls.X509KeyPair([]byte(APNSCertMock), []byte(APNSKeyMock))
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 	config := tls.Config{Certificates: []tls.Certificate{crt}, ClientAuth: tls.RequireAnyClientCert}
-	log.Print("- starting Mock Apple Feedback TCP server at 0.0.0.0:5555")
-
-	srv, _ := tls.Listen("tcp", "0.0.0.0:5555", &config)
-	for {
-		conn, err := srv.Accept()
-		if err != nil {
-			log.Fatal(err)
+	srv, err := tls.Listen("tcp", "127.0.0.1:0", &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for i := 0; i < len(data); i += 5 {
+					end := i + 5
+					if end > len(data) {
+						end = len(data)
+					}
+					conn.Write(data[i:end])
+					time.Sleep(time.Millisecond)
+				}
+			}(conn)
 		}
-		go loop(conn)
+	}()
+	return srv
+}
+
+func TestReadFeedback(t *testing.T) {
+	data := append(feedbackTuple(1368809290, bytes.Repeat([]byte{0xab}, 32)), feedbackTuple(1368809291, bytes.Repeat([]byte{0xcd}, 64))...)
+
+	resp, err := ReadFeedback(iotest.OneByteReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 2 {
+		t.Fatalf("expected 2 responses got %d", len(resp))
+	}
+	if !resp[0].Timestamp.Equal(time.Unix(1368809290, 0)) || resp[0].TokenLength != 32 || len(resp[0].DeviceToken) != 64 {
+		t.Fatalf("unexpected response %+v", resp[0])
+	}
+	if resp[1].TokenLength != 64 || resp[1].DeviceToken[:4] != "cdcd" {
+		t.Fatalf("unexpected response %+v", resp[1])
+	}
+
+	// Cut off in the middle of the second token.
+	resp, err = ReadFeedback(bytes.NewReader(data[:len(data)-10]))
+	if err == nil {
+		t.Fatal("expected error for a partial tuple")
+	}
+	if len(resp) != 1 {
+		t.Fatalf("expected the complete tuple got %d", len(resp))
 	}
 }
 
-// Writes binary data to the client in the same
-// manner as the Apple service would.
-//
-// [4 bytes, 2 bytes, 32 bytes] = 38 bytes total
-func loopFeedback(conn net.Conn) {
-	defer conn.Close()
-	for {
-		timeT := uint32(1368809290) // 2013-05-17 12:48:10 -0400
-		token := "abcd1234efab5678abcd1234efab5678"
-
-		buf := new(bytes.Buffer)
-		binary.Write(buf, binary.BigEndian, timeT)
-		binary.Write(buf, binary.BigEndian, uint16(len(token)))
-		binary.Write(buf, binary.BigEndian, []byte(token))
-		conn.Write(buf.Bytes())
-
-		dur, _ := time.ParseDuration("1s")
-		time.Sleep(dur)
+func TestAPNSFeedback(t *testing.T) {
+	data := append(feedbackTuple(1368809290, bytes.Repeat([]byte{0xab}, 32)), feedbackTuple(1368809291, bytes.Repeat([]byte{0xcd}, 32))...)
+	srv := mockFeedbackServer(t, data)
+	defer srv.Close()
+
+	c, _ := NewAPNSClient(APNSGateway, APNSCertMock, APNSKeyMock)
+	c.InsecureSkipVerify = true
+	if c.FeedbackGateway != APNSFeedbackURLs["testing"] {
+		t.Fatalf("feedback gateway not set %s", c.FeedbackGateway)
+	}
+	c.FeedbackGateway = srv.Addr().String()
+	// Registered again after apple's timestamp, it must not be removed.
+	store := NewMemoryTokenStore()
+	store.Add(PlatformAPNS, strings.Repeat("ab", 32))
+	c.Tokens = store
+
+	resp, err := c.Feedback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 2 {
+		t.Fatalf("expected 2 responses got %d", len(resp))
+	}
+	if _, ok, _ := store.Lookup(PlatformAPNS, resp[0].DeviceToken); !ok {
+		t.Fatal("feedback removed a token")
+	}
+}
+
+func TestAPNSRunFeedback(t *testing.T) {
+	srv := mockFeedbackServer(t, feedbackTuple(1368809290, bytes.Repeat([]byte{0xab}, 32)))
+	defer srv.Close()
+
+	c, _ := NewAPNSClient(APNSGateway, APNSCertMock, APNSKeyMock)
+	c.InsecureSkipVerify = true
+	c.FeedbackGateway = srv.Addr().String()
+
+	results := make(chan []*FeedbackResponse, 10)
+	stop := c.RunFeedback(10*time.Millisecond, func(resp []*FeedbackResponse, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		select {
+		case results <- resp:
+		default:
+		}
+	})
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-results:
+			if len(resp) != 1 {
+				t.Fatalf("expected 1 response got %d", len(resp))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("feedback not run")
+		}
 	}
 }
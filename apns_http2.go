@@ -0,0 +1,191 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APNSHTTP2URLs map environment to the http/2 provider api.
+var APNSHTTP2URLs = map[string]string{
+	"testing":         "https://localhost:5557",
+	"development":     "https://api.sandbox.push.apple.com",
+	"staging":         "https://api.sandbox.push.apple.com",
+	"staging_sandbox": "https://api.sandbox.push.apple.com",
+	"sandbox":         "https://api.sandbox.push.apple.com",
+	"production":      "https://api.push.apple.com",
+}
+
+// APNSHTTP2Path requires the device token to be injected.
+var APNSHTTP2Path = "/3/device/%s"
+
+// apnsHTTP2Error is the json body returned by apns on failure.
+type apnsHTTP2Error struct {
+	Reason string `json:"reason"`
+	// Timestamp is milliseconds since epoch, only set with a 410.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// APNSHTTP2Client sends notifications with the apns http/2 provider api.
+// It authenticates with either a certificate or a provider token.
+type APNSHTTP2Client struct {
+	Certificate string
+	Key         string
+	Gateway     string
+	Token       *APNSToken
+	// RetryPolicy sets the backoff when apple gives no Retry-After,
+	// nil uses DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+	// Tokens removes the tokens apple reports as no longer active if set.
+	Tokens TokenStore
+	http   *http.Client
+}
+
+// NewAPNSHTTP2Client returns a client authenticating with the cert and key
+// for the app. gateway is the base url, see APNSHTTP2URLs.
+func NewAPNSHTTP2Client(gateway, cert, key string) (*APNSHTTP2Client, error) {
+	if gateway == "" {
+		return nil, fmt.Errorf("gateway not provided")
+	}
+	crt, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &APNSHTTP2Client{
+		Certificate: cert,
+		Key:         key,
+		Gateway:     gateway,
+		http:        newAPNSHTTP2Client([]tls.Certificate{crt}),
+	}, nil
+}
+
+// NewAPNSHTTP2TokenClient returns a client authenticating with provider
+// tokens. Every notification sent must have its Topic set.
+func NewAPNSHTTP2TokenClient(gateway string, token *APNSToken) (*APNSHTTP2Client, error) {
+	if gateway == "" {
+		return nil, fmt.Errorf("gateway not provided")
+	}
+	if token == nil {
+		return nil, fmt.Errorf("token not provided")
+	}
+
+	return &APNSHTTP2Client{
+		Gateway: gateway,
+		Token:   token,
+		http:    newAPNSHTTP2Client(nil),
+	}, nil
+}
+
+// newAPNSHTTP2Client ...
+func newAPNSHTTP2Client(certs []tls.Certificate) *http.Client {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: certs,
+		},
+		ForceAttemptHTTP2: true,
+	}
+	return &http.Client{Transport: tr, Timeout: 30 * time.Second}
+}
+
+// Send posts the notification to /3/device/<token>.
+func (c *APNSHTTP2Client) Send(apn *APNSPushNotification) (*APNSResponse, error) {
+	if c.Token != nil && apn.Topic == "" {
+		return nil, fmt.Errorf("topic required with token authentication")
+	}
+	payload, err := apn.validate(c.MaxPayloadSize(apn))
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("POST", fmt.Sprintf(c.Gateway+APNSHTTP2Path, apn.DeviceToken), bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if c.Token != nil {
+		bearer, err := c.Token.Bearer()
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "bearer "+bearer)
+	}
+	if apn.Expiry > 0 {
+		request.Header.Set("apns-expiration", strconv.FormatUint(uint64(apn.Expiry), 10))
+	}
+	if apn.Priority > 0 {
+		request.Header.Set("apns-priority", strconv.Itoa(int(apn.Priority)))
+	}
+	if apn.Topic != "" {
+		request.Header.Set("apns-topic", apn.Topic)
+	}
+	if apn.CollapseID != "" {
+		request.Header.Set("apns-collapse-id", apn.CollapseID)
+	}
+	if apn.PushType != "" {
+		request.Header.Set("apns-push-type", apn.PushType)
+	}
+
+	resp, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	apr := &APNSResponse{
+		Identifier: apn.Identifier,
+		StatusCode: resp.StatusCode,
+		ID:         resp.Header.Get("apns-id"),
+		RetryAfter: -1,
+	}
+	if resp.StatusCode == 200 {
+		return apr, nil
+	}
+
+	e := apnsHTTP2Error{}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &e)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected response %s %s", resp.Status, string(body))
+		}
+	}
+	apr.Reason = e.Reason
+	if e.Timestamp > 0 {
+		apr.Timestamp = time.Unix(0, e.Timestamp*int64(time.Millisecond))
+	}
+
+	switch {
+	case resp.StatusCode == 410, e.Reason == "BadDeviceToken", e.Reason == "Unregistered":
+		// The device token is no longer active for the topic,
+		// or is not valid at all.
+		apr.Error = ErrRemoveToken
+	case e.Reason == "ExpiredProviderToken" && c.Token != nil:
+		// Sign a new token and retry right away.
+		c.Token.expire()
+		apr.RetryAfter = 0
+		apr.Error = ErrTokenExpired
+	case resp.StatusCode == 429, resp.StatusCode >= 500:
+		// TooManyRequests, InternalServerError, ServiceUnavailable, Shutdown.
+		apr.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
+		apr.Error = ErrRetry
+	default:
+		apr.Error = fmt.Errorf("apns %d %s", resp.StatusCode, e.Reason)
+	}
+
+	if apr.Error == ErrRemoveToken {
+		err = storeTokens(c.Tokens, PlatformAPNS, tokenChange{old: apn.DeviceToken})
+		if err != nil {
+			apr.Error = err
+		}
+	}
+	return apr, apr.Error
+}
@@ -0,0 +1,139 @@
+package hermes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// APNSHTTP2Server is a stand-in for the apns provider api. Tokens
+// starting with "bad0", "dead" and "beef" return the matching errors.
+var APNSHTTP2Server *httptest.Server
+
+func init() {
+	APNSHTTP2Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(505)
+			fmt.Fprintln(w, `{"reason":"HTTPVersionNotSupported"}`)
+			return
+		}
+		if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, "/3/device/") {
+			w.WriteHeader(405)
+			fmt.Fprintln(w, `{"reason":"MethodNotAllowed"}`)
+			return
+		}
+		payload := map[string]interface{}{}
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"reason":"PayloadEmpty"}`)
+			return
+		}
+		if _, ok := payload["aps"]; !ok {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"reason":"PayloadEmpty"}`)
+			return
+		}
+
+		w.Header().Set("apns-id", "EC1BF194-B3B2-424A-89A9-5A918A6E4A1B")
+		token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+		switch {
+		case strings.HasPrefix(token, "bad0"):
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"reason":"BadDeviceToken"}`)
+		case strings.HasPrefix(token, "dead"):
+			w.WriteHeader(410)
+			fmt.Fprintln(w, `{"reason":"Unregistered","timestamp":1368809290000}`)
+		case strings.HasPrefix(token, "beef"):
+			w.WriteHeader(503)
+			fmt.Fprintln(w, `{"reason":"ServiceUnavailable"}`)
+		case r.Header.Get("apns-priority") != "10":
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"reason":"BadPriority"}`)
+		default:
+			w.WriteHeader(200)
+		}
+	}))
+	APNSHTTP2Server.EnableHTTP2 = true
+	APNSHTTP2Server.StartTLS()
+}
+
+func TestNewAPNSHTTP2Client(t *testing.T) {
+	c, err := NewAPNSHTTP2Client(APNSHTTP2URLs["testing"], APNSCertMock, APNSKeyMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Gateway != APNSHTTP2URLs["testing"] {
+		t.Fatal("gateway not set")
+	}
+	_, err = NewAPNSHTTP2Client("", APNSCertMock, APNSKeyMock)
+	if err == nil {
+		t.Fatal("expected error without gateway")
+	}
+}
+
+func TestAPNSHTTP2Send(t *testing.T) {
+	c, err := NewAPNSHTTP2Client(APNSHTTP2Server.URL, APNSCertMock, APNSKeyMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.http = APNSHTTP2Server.Client()
+
+	apn, _ := NewAPNSPushNotification("E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4", &APNSMessage{Alert: "hello"}, 0)
+	resp, err := c.Send(apn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("didn't get back 200 got: %+v", resp)
+	}
+	if resp.ID == "" {
+		t.Fatal("apns-id not set")
+	}
+	if resp.Retry() != -1 || resp.UpdateToken() {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestAPNSHTTP2SendErrors(t *testing.T) {
+	c, err := NewAPNSHTTP2Client(APNSHTTP2Server.URL, APNSCertMock, APNSKeyMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.http = APNSHTTP2Server.Client()
+
+	apn, _ := NewAPNSPushNotification("bad0", &APNSMessage{Alert: "hello"}, 0)
+	resp, err := c.Send(apn)
+	if err != ErrRemoveToken || resp.StatusCode != 400 || resp.Reason != "BadDeviceToken" {
+		t.Fatalf("expected bad device token got %+v", resp)
+	}
+
+	apn.DeviceToken = "dead"
+	resp, err = c.Send(apn)
+	if err != ErrRemoveToken || resp.StatusCode != 410 || resp.Reason != "Unregistered" {
+		t.Fatalf("expected unregistered got %+v", resp)
+	}
+	if !resp.Timestamp.Equal(time.Unix(1368809290, 0)) {
+		t.Fatalf("timestamp not set %v", resp.Timestamp)
+	}
+	if !resp.UpdateToken() {
+		t.Fatal("should update token")
+	}
+
+	apn.DeviceToken = "beef"
+	resp, err = c.Send(apn)
+	if err != ErrRetry || resp.Retry() < 0 {
+		t.Fatalf("expected retry got %+v", resp)
+	}
+
+	apn.DeviceToken = "E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4"
+	apn.Priority = 5
+	resp, err = c.Send(apn)
+	if err == nil || resp.Reason != "BadPriority" {
+		t.Fatalf("expected bad priority got %+v", resp)
+	}
+}
@@ -0,0 +1,149 @@
+package hermes
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Payload size limits for each transport in bytes.
+const (
+	APNSMaxPayloadBinary = 2048
+	APNSMaxPayloadHTTP2  = 4096
+	APNSMaxPayloadVoIP   = 5120
+)
+
+// Push types sent in the apns-push-type header.
+const (
+	APNSPushTypeAlert      = "alert"
+	APNSPushTypeBackground = "background"
+	APNSPushTypeVoIP       = "voip"
+)
+
+// apnsEllipsis is appended to a truncated alert body.
+const apnsEllipsis = "…"
+
+// APNSPayloadSizeError is returned for a payload over the limit.
+type APNSPayloadSizeError struct {
+	Size  int
+	Limit int
+}
+
+// Error ...
+func (e *APNSPayloadSizeError) Error() string {
+	return fmt.Sprintf("payload of %d bytes is %d over the %d byte limit", e.Size, e.Size-e.Limit, e.Limit)
+}
+
+// MaxPayloadSize is the binary protocol's limit, APNSMaxPayloadBinary
+// whatever the push type.
+func (c *APNSClient) MaxPayloadSize(apn *APNSPushNotification) int {
+	return APNSMaxPayloadBinary
+}
+
+// Validate checks the notification can be sent with Send.
+func (c *APNSClient) Validate(apn *APNSPushNotification) error {
+	return apn.Validate(c.MaxPayloadSize(apn))
+}
+
+// MaxPayloadSize is the http/2 limit for the notification's push type.
+func (c *APNSHTTP2Client) MaxPayloadSize(apn *APNSPushNotification) int {
+	if apn.PushType == APNSPushTypeVoIP {
+		return APNSMaxPayloadVoIP
+	}
+	return APNSMaxPayloadHTTP2
+}
+
+// Validate checks the notification can be sent with Send.
+func (c *APNSHTTP2Client) Validate(apn *APNSPushNotification) error {
+	return apn.Validate(c.MaxPayloadSize(apn))
+}
+
+// Validate checks the device token and that the payload fits in limit,
+// the error is an *APNSPayloadSizeError if it doesn't. The limit depends
+// on the transport, see the clients' MaxPayloadSize.
+func (a *APNSPushNotification) Validate(limit int) error {
+	_, err := a.validate(limit)
+	return err
+}
+
+// validate returns the encoded payload if it fits in limit.
+func (a *APNSPushNotification) validate(limit int) ([]byte, error) {
+	if a.DeviceToken == "" {
+		return nil, fmt.Errorf("no device token")
+	}
+	if _, err := hex.DecodeString(a.DeviceToken); err != nil {
+		return nil, fmt.Errorf("invalid device token %s", err)
+	}
+	payload, err := json.Marshal(a.payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > limit {
+		return nil, &APNSPayloadSizeError{Size: len(payload), Limit: limit}
+	}
+	return payload, nil
+}
+
+// Truncate shortens the alert body, ending it with an ellipsis, until the
+// payload fits in limit, see the clients' MaxPayloadSize. Custom fields
+// are left alone, so if they alone don't fit an *APNSPayloadSizeError is
+// returned and the notification is unchanged.
+func (a *APNSPushNotification) Truncate(limit int) error {
+	if limit <= 0 {
+		return fmt.Errorf("invalid payload limit %d", limit)
+	}
+	payload, err := json.Marshal(a.payload)
+	if err != nil {
+		return err
+	}
+	if len(payload) <= limit {
+		return nil
+	}
+	sizeErr := &APNSPayloadSizeError{Size: len(payload), Limit: limit}
+
+	ap, ok := a.payload["aps"].(*APNSMessage)
+	if !ok || ap == nil {
+		return sizeErr
+	}
+	// Copy the message so one shared between notifications isn't modified.
+	m := *ap
+	var body string
+	var setBody func(string)
+	switch alert := m.Alert.(type) {
+	case string:
+		body = alert
+		setBody = func(s string) { m.Alert = s }
+	case *APNSAlertDictionary:
+		d := *alert
+		body = d.Body
+		setBody = func(s string) {
+			d.Body = s
+			m.Alert = &d
+		}
+	default:
+		return sizeErr
+	}
+
+	// Find the most runes of the body that fit.
+	runes := []rune(body)
+	fits := func(n int) bool {
+		setBody(string(runes[:n]) + apnsEllipsis)
+		a.payload["aps"] = &m
+		b, err := json.Marshal(a.payload)
+		return err == nil && len(b) <= limit
+	}
+	lo, hi := -1, len(runes)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	if lo < 0 || !fits(lo) {
+		a.payload["aps"] = ap
+		return sizeErr
+	}
+	return nil
+}
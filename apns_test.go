@@ -4,10 +4,16 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -63,49 +69,74 @@ l2N13a1hUxAt4VvyG57AwxaKo4FDNi9QHMmhwXvGC4Qt/qEyU1EL
 `
 )
 
-// This is a simple stand-in for the Apple feedback service that
-// can be used for testing purposes.
-func mockServer(cert, key string) {
+// mockResponse is the error response mockServer writes before closing
+// the connection, like apple does when it rejects a notification.
+type mockResponse struct {
+	Status     uint8
+	Identifier int32
+}
+
+// mockServer is a simple stand-in for the Apple gateway that can be
+// used for testing purposes. Every notification read is passed to
+// onNotification with the index of the connection it was read from, a
+// non nil response rejects it. A nil onNotification accepts everything.
+func mockServer(addr, cert, key string, onNotification func(conn int, items *apnsFrameItems) *mockResponse) (net.Listener, error) {
 	crt, err := tls.X509KeyPair([]byte(cert), []byte(key))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	config := tls.Config{Certificates: []tls.Certificate{crt}, ClientAuth: tls.RequireAnyClientCert}
-	log.Info("- starting Mock Apple TCP server at " + APNSGateway)
-
-	srv, err := tls.Listen("tcp", APNSGateway, &config)
+	srv, err := tls.Listen("tcp", addr, &config)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	for {
-		conn, err := srv.Accept()
-		if err != nil {
-			log.Fatal(err)
+	log.Print("- starting Mock Apple TCP server at " + srv.Addr().String())
+
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go loop(conn, i, onNotification)
 		}
-		go loop(conn)
-	}
+	}()
+	return srv, nil
 }
 
-// Writes binary data to the client in the same
-// manner as the Apple service would.
+// loop reads the notifications written on conn until one is rejected,
+// then writes the error response in the same manner as the Apple
+// service would.
 //
 // [1 byte, 1 byte, 4 bytes] = 6 bytes total
-func loop(conn net.Conn) {
+func loop(conn net.Conn, i int, onNotification func(conn int, items *apnsFrameItems) *mockResponse) {
 	defer conn.Close()
 	for {
+		items, err := readAPNSNotification(conn)
+		if err != nil {
+			return
+		}
+		if onNotification == nil {
+			continue
+		}
+		resp := onNotification(i, items)
+		if resp == nil {
+			continue
+		}
 		buf := new(bytes.Buffer)
 		binary.Write(buf, binary.BigEndian, uint8(8))
-		binary.Write(buf, binary.BigEndian, uint8(0))
-		binary.Write(buf, binary.BigEndian, uint32(0))
+		binary.Write(buf, binary.BigEndian, resp.Status)
+		binary.Write(buf, binary.BigEndian, resp.Identifier)
 		conn.Write(buf.Bytes())
-		time.Sleep(150 * time.Millisecond)
+		return
 	}
 }
 
 func init() {
-	go func() {
-		mockServer(APNSCertMock, APNSKeyMock)
-	}()
+	_, err := mockServer(APNSGateway, APNSCertMock, APNSKeyMock, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func TestNewAPNSClient(t *testing.T) {
@@ -154,3 +185,344 @@ func TestAPNSConnClose(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// apnsFrameItems are the items of a command 2 notification frame.
+type apnsFrameItems struct {
+	Token      []byte
+	Payload    []byte
+	Identifier int32
+	Expiry     uint32
+	Priority   uint8
+}
+
+// readAPNSNotification reads one notification frame written by Send.
+func readAPNSNotification(r io.Reader) (*apnsFrameItems, error) {
+	header := struct {
+		Command uint8
+		Length  uint32
+	}{}
+	err := binary.Read(r, binary.BigEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Command != 2 {
+		return nil, fmt.Errorf("expected command 2 got %d", header.Command)
+	}
+	frame := make([]byte, header.Length)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	items := &apnsFrameItems{}
+	fr := bytes.NewReader(frame)
+	for fr.Len() > 0 {
+		item := struct {
+			ID     uint8
+			Length uint16
+		}{}
+		err = binary.Read(fr, binary.BigEndian, &item)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, item.Length)
+		_, err = io.ReadFull(fr, data)
+		if err != nil {
+			return nil, err
+		}
+		switch item.ID {
+		case 1:
+			items.Token = data
+		case 2:
+			items.Payload = data
+		case 3:
+			items.Identifier = int32(binary.BigEndian.Uint32(data))
+		case 4:
+			items.Expiry = binary.BigEndian.Uint32(data)
+		case 5:
+			items.Priority = data[0]
+		default:
+			return nil, fmt.Errorf("unknown item %d", item.ID)
+		}
+	}
+	return items, nil
+}
+
+// mockRejectServer rejects the failAt'th notification of the first
+// connection with status 8 once it has read total notifications.
+// Identifiers read on later connections are sent on resent.
+func mockRejectServer(t *testing.T, failAt, total int, resent chan int32) net.Listener {
+	read := 0
+	var failed int32
+	srv, err := mockServer("127.0.0.1:0", APNSCertMock, APNSKeyMock, func(conn int, items *apnsFrameItems) *mockResponse {
+		if conn > 0 {
+			resent <- items.Identifier
+			return nil
+		}
+		read++
+		if read == failAt {
+			failed = items.Identifier
+		}
+		if read < total {
+			return nil
+		}
+		return &mockResponse{Status: 8, Identifier: failed}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestAPNSResendAfterError(t *testing.T) {
+	resent := make(chan int32, 10)
+	srv := mockRejectServer(t, 3, 5, resent)
+	defer srv.Close()
+
+	c, err := NewAPNSClient(srv.Addr().String(), APNSCertMock, APNSKeyMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type failure struct {
+		apn  *APNSPushNotification
+		resp *APNSResponse
+	}
+	failures := make(chan failure, 10)
+	c.OnError = func(apn *APNSPushNotification, resp *APNSResponse) {
+		failures <- failure{apn, resp}
+	}
+	// Use a single connection so the failure applies to all of them.
+	c.Pool = &APNSPool{pool: make(chan *APNSConn, 1), nClients: 1}
+	conn, _ := newAPNSConn(srv.Addr().String(), APNSCertMock, APNSKeyMock, c.handleError)
+	c.Pool.Release(conn)
+
+	sent := []int32{}
+	for i := 0; i < 5; i++ {
+		apn, _ := NewAPNSPushNotification("E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4", &APNSMessage{Alert: "hello"}, 0)
+		_, err := c.Send(apn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, apn.Identifier)
+	}
+
+	select {
+	case f := <-failures:
+		if f.apn.Identifier != sent[2] {
+			t.Fatalf("expected %d to fail got %d", sent[2], f.apn.Identifier)
+		}
+		if f.resp.Error != ErrRemoveToken || f.resp.Status != 8 {
+			t.Fatalf("expected invalid token got %+v", f.resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("error not reported")
+	}
+
+	for _, want := range sent[3:] {
+		select {
+		case id := <-resent:
+			if id != want {
+				t.Fatalf("expected %d to be resent got %d", want, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d not resent", want)
+		}
+	}
+	select {
+	case id := <-resent:
+		t.Fatalf("unexpected resend of %d", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAPNSFrameItems(t *testing.T) {
+	frames := make(chan *apnsFrameItems, 2)
+	srv, err := mockServer("127.0.0.1:0", APNSCertMock, APNSKeyMock, func(conn int, items *apnsFrameItems) *mockResponse {
+		frames <- items
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	c, _ := NewAPNSClient(srv.Addr().String(), APNSCertMock, APNSKeyMock)
+	token := "E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4"
+	apn, _ := NewAPNSPushNotification(token, &APNSMessage{Alert: "hello"}, 1368809290)
+	apn.Priority = 5
+	_, err = c.Send(apn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case items := <-frames:
+		if hex.EncodeToString(items.Token) != strings.ToLower(token) {
+			t.Fatalf("token not sent %x", items.Token)
+		}
+		if string(items.Payload) != `{"aps":{"alert":"hello"}}` {
+			t.Fatalf("payload not sent %s", items.Payload)
+		}
+		if items.Identifier != apn.Identifier || items.Expiry != 1368809290 {
+			t.Fatalf("identifier or expiry not sent %+v", items)
+		}
+		if items.Priority != 5 {
+			t.Fatalf("expected priority 5 got %d", items.Priority)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not received")
+	}
+}
+
+func TestAPNSRing(t *testing.T) {
+	r := newAPNSRing(3)
+	for i := int32(1); i <= 4; i++ {
+		r.add(&apnsSent{apn: &APNSPushNotification{Identifier: i}})
+	}
+	failed, later := r.after(3)
+	if failed == nil || failed.apn.Identifier != 3 || len(later) != 1 || later[0].apn.Identifier != 4 {
+		t.Fatalf("unexpected %+v %+v", failed, later)
+	}
+	// 1 was dropped, everything buffered was sent after it.
+	failed, later = r.after(1)
+	if failed != nil || len(later) != 3 || later[0].apn.Identifier != 2 {
+		t.Fatalf("unexpected %+v %+v", failed, later)
+	}
+	r.reset()
+	_, later = r.after(1)
+	if len(later) != 0 {
+		t.Fatal("ring not reset")
+	}
+}
+
+func TestAPNSMessageJSON(t *testing.T) {
+	tests := []struct {
+		m    *APNSMessage
+		want string
+	}{
+		{&APNSMessage{}, `{}`},
+		{&APNSMessage{Badge: 3}, `{"badge":3}`},
+		{&APNSMessage{ClearBadge: true}, `{"badge":0}`},
+		{&APNSMessage{ContentAvailable: 1}, `{"content-available":1}`},
+		{
+			&APNSMessage{
+				Alert: &APNSAlertDictionary{
+					Title:           "Game Request",
+					Subtitle:        "Five Card Draw",
+					Body:            "Bob wants to play poker",
+					TitleLocKey:     "GAME_TITLE",
+					SummaryArg:      "Bob",
+					SummaryArgCount: 2,
+				},
+				MutableContent:    1,
+				Category:          "GAME_INVITATION",
+				ThreadID:          "poker",
+				InterruptionLevel: APNSInterruptionCritical,
+				RelevanceScore:    0.5,
+				Sound:             &APNSSound{Critical: 1, Name: "alarm.aiff", Volume: 0.8},
+			},
+			`{"alert":{"title":"Game Request","subtitle":"Five Card Draw","body":"Bob wants to play poker","title-loc-key":"GAME_TITLE","summary-arg":"Bob","summary-arg-count":2},"sound":{"critical":1,"name":"alarm.aiff","volume":0.8},"mutable-content":1,"category":"GAME_INVITATION","thread-id":"poker","interruption-level":"critical","relevance-score":0.5}`,
+		},
+	}
+	for _, test := range tests {
+		b, err := test.m.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.want {
+			t.Fatalf("expected %s got %s", test.want, b)
+		}
+	}
+
+	apn, _ := NewAPNSPushNotification("E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4", &APNSMessage{ClearBadge: true}, 0)
+	b, _ := json.Marshal(apn.payload)
+	if string(b) != `{"aps":{"badge":0}}` {
+		t.Fatalf("badge not cleared in payload %s", b)
+	}
+}
+
+func TestAPNSPushNotificationValidate(t *testing.T) {
+	token := "E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4"
+	legacy, h2 := &APNSClient{}, &APNSHTTP2Client{}
+	apn, _ := NewAPNSPushNotification(token, &APNSMessage{Alert: strings.Repeat("a", 4000)}, 0)
+	err := h2.Validate(apn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Too large for the binary protocol, Send fails the same way.
+	err = legacy.Validate(apn)
+	sizeErr, ok := err.(*APNSPayloadSizeError)
+	if !ok {
+		t.Fatalf("expected size error got %v", err)
+	}
+	// {"aps":{"alert":"..."}}
+	if sizeErr.Size != 4020 || sizeErr.Limit != APNSMaxPayloadBinary {
+		t.Fatalf("unexpected overflow %+v", sizeErr)
+	}
+	c, _ := NewAPNSClient(APNSGateway, APNSCertMock, APNSKeyMock)
+	if _, err = c.Send(apn); err == nil || err.Error() != sizeErr.Error() {
+		t.Fatalf("expected %v got %v", sizeErr, err)
+	}
+
+	apn.Set("custom", strings.Repeat("b", 1000))
+	err = h2.Validate(apn)
+	if _, ok := err.(*APNSPayloadSizeError); !ok {
+		t.Fatalf("expected size error got %v", err)
+	}
+	apn.PushType = APNSPushTypeVoIP
+	err = h2.Validate(apn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := legacy.Validate(apn).(*APNSPayloadSizeError); !ok {
+		t.Fatal("expected voip over the binary limit")
+	}
+
+	apn.DeviceToken = "not hex"
+	if h2.Validate(apn) == nil {
+		t.Fatal("expected invalid token")
+	}
+}
+
+func TestAPNSPushNotificationTruncate(t *testing.T) {
+	token := "E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4"
+	ap := &APNSMessage{Alert: &APNSAlertDictionary{Title: "hi", Body: strings.Repeat("é", 1500)}}
+	apn, _ := NewAPNSPushNotification(token, ap, 0)
+	apn.Set("custom", "keep")
+
+	if apn.Truncate(0) == nil {
+		t.Fatal("expected error without a limit")
+	}
+	err := apn.Truncate(APNSMaxPayloadBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := apn.validate(APNSMaxPayloadBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) < APNSMaxPayloadBinary-2 {
+		t.Fatalf("truncated more than needed %d", len(payload))
+	}
+	body := apn.Get("aps").(*APNSMessage).Alert.(*APNSAlertDictionary).Body
+	if !utf8.ValidString(body) || !strings.HasSuffix(body, "…") {
+		t.Fatalf("invalid truncated body %q", body)
+	}
+	if apn.Get("custom") != "keep" {
+		t.Fatal("custom field modified")
+	}
+	if len(ap.Alert.(*APNSAlertDictionary).Body) != 3000 {
+		t.Fatal("original message modified")
+	}
+
+	// Custom fields alone are too large.
+	apn, _ = NewAPNSPushNotification(token, &APNSMessage{Alert: "hello"}, 0)
+	apn.Set("custom", strings.Repeat("b", 3000))
+	err = apn.Truncate(APNSMaxPayloadBinary)
+	if _, ok := err.(*APNSPayloadSizeError); !ok {
+		t.Fatalf("expected size error got %v", err)
+	}
+	if apn.Get("aps").(*APNSMessage).Alert != "hello" {
+		t.Fatal("alert modified")
+	}
+}
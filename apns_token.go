@@ -0,0 +1,74 @@
+package hermes
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// APNSTokenLifetime is how long a provider token is reused. Apple rejects
+// tokens older than an hour and refreshes more often than every 20 minutes.
+var APNSTokenLifetime = 50 * time.Minute
+
+// APNSToken signs provider authentication tokens (JWT ES256) with
+// the .p8 signing key of a team. One token can be shared by every app
+// of the team.
+type APNSToken struct {
+	KeyID  string
+	TeamID string
+	key    *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	bearer   string
+	issuedAt time.Time
+}
+
+// NewAPNSToken parses the PEM encoded PKCS#8 key from the .p8 file.
+func NewAPNSToken(keyID, teamID string, p8 []byte) (*APNSToken, error) {
+	if keyID == "" || teamID == "" {
+		return nil, fmt.Errorf("key id and team id required")
+	}
+	key, err := parseECPrivateKey(p8)
+	if err != nil {
+		return nil, err
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("key must use the P-256 curve")
+	}
+	return &APNSToken{
+		KeyID:  keyID,
+		TeamID: teamID,
+		key:    key,
+	}, nil
+}
+
+// Bearer returns the cached token, signing a new one once the
+// current one is older than APNSTokenLifetime.
+func (t *APNSToken) Bearer() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.bearer != "" && now.Sub(t.issuedAt) < APNSTokenLifetime {
+		return t.bearer, nil
+	}
+
+	header := map[string]string{"alg": "ES256", "kid": t.KeyID}
+	claims := map[string]interface{}{"iss": t.TeamID, "iat": now.Unix()}
+	bearer, err := encodeJWT(header, claims, es256Signer(t.key))
+	if err != nil {
+		return "", err
+	}
+	t.bearer = bearer
+	t.issuedAt = now
+	return t.bearer, nil
+}
+
+// expire drops the cached token so the next request signs a new one.
+func (t *APNSToken) expire() {
+	t.mu.Lock()
+	t.bearer = ""
+	t.mu.Unlock()
+}
@@ -0,0 +1,162 @@
+package hermes
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	// APNSTokenServer verifies the provider token signed with
+	// APNSTokenP8 on each request. It answers ExpiredProviderToken once
+	// apnsTokenExpire is set.
+	APNSTokenServer *httptest.Server
+	APNSTokenP8     []byte
+	apnsTokenExpire int32
+)
+
+// newTestP8 returns a fresh signing key encoded like a .p8 file.
+func newTestP8() (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func init() {
+	var key *ecdsa.PrivateKey
+	key, APNSTokenP8 = newTestP8()
+	pub := &key.PublicKey
+	APNSTokenServer = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "bearer ") {
+			w.WriteHeader(403)
+			fmt.Fprintln(w, `{"reason":"MissingProviderToken"}`)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(auth, "bearer "), ".")
+		if len(parts) != 3 {
+			w.WriteHeader(403)
+			fmt.Fprintln(w, `{"reason":"InvalidProviderToken"}`)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if !verifyES256(pub, []byte(parts[0]+"."+parts[1]), sig) {
+			w.WriteHeader(403)
+			fmt.Fprintln(w, `{"reason":"InvalidProviderToken"}`)
+			return
+		}
+		header := map[string]string{}
+		claims := map[string]interface{}{}
+		h, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		c, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(h, &header)
+		json.Unmarshal(c, &claims)
+		if header["alg"] != "ES256" || header["kid"] != "ABC123DEFG" || claims["iss"] != "DEF123GHIJ" {
+			w.WriteHeader(403)
+			fmt.Fprintln(w, `{"reason":"InvalidProviderToken"}`)
+			return
+		}
+		if r.Header.Get("apns-topic") == "" {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"reason":"MissingTopic"}`)
+			return
+		}
+		if atomic.CompareAndSwapInt32(&apnsTokenExpire, 1, 0) {
+			w.WriteHeader(403)
+			fmt.Fprintln(w, `{"reason":"ExpiredProviderToken"}`)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	APNSTokenServer.EnableHTTP2 = true
+	APNSTokenServer.StartTLS()
+}
+
+func TestNewAPNSToken(t *testing.T) {
+	_, err := NewAPNSToken("ABC123DEFG", "DEF123GHIJ", APNSTokenP8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewAPNSToken("", "DEF123GHIJ", APNSTokenP8)
+	if err == nil {
+		t.Fatal("expected error without key id")
+	}
+	_, err = NewAPNSToken("ABC123DEFG", "DEF123GHIJ", []byte(APNSKeyMock))
+	if err == nil {
+		t.Fatal("expected error with rsa key")
+	}
+}
+
+func TestAPNSTokenBearer(t *testing.T) {
+	token, _ := NewAPNSToken("ABC123DEFG", "DEF123GHIJ", APNSTokenP8)
+
+	b1, err := token.Bearer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, _ := token.Bearer()
+	if b1 != b2 {
+		t.Fatal("token should be cached")
+	}
+
+	// Rotate once the lifetime has passed.
+	token.issuedAt = time.Now().Add(-APNSTokenLifetime)
+	b3, _ := token.Bearer()
+	if b3 == b1 {
+		t.Fatal("token should be rotated")
+	}
+}
+
+func TestAPNSHTTP2TokenSend(t *testing.T) {
+	token, _ := NewAPNSToken("ABC123DEFG", "DEF123GHIJ", APNSTokenP8)
+	c, err := NewAPNSHTTP2TokenClient(APNSTokenServer.URL, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.http = APNSTokenServer.Client()
+
+	apn, _ := NewAPNSPushNotification("E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4", &APNSMessage{Alert: "hello"}, 0)
+	_, err = c.Send(apn)
+	if err == nil {
+		t.Fatal("expected error without topic")
+	}
+
+	apn.Topic = "com.example.app"
+	resp, err := c.Send(apn)
+	if err != nil {
+		t.Fatalf("%s %+v", err, resp)
+	}
+
+	atomic.StoreInt32(&apnsTokenExpire, 1)
+	old, _ := token.Bearer()
+	resp, err = c.Send(apn)
+	if err != ErrTokenExpired || resp.Retry() != 0 {
+		t.Fatalf("expected expired token got %+v", resp)
+	}
+	renewed, _ := token.Bearer()
+	if renewed == old {
+		t.Fatal("token should be renewed after ExpiredProviderToken")
+	}
+	_, err = c.Send(apn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,7 +1,5 @@
 package hermes
 
-// NOTE untested
-
 import (
 	"encoding/json"
 	"fmt"
@@ -9,7 +7,6 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
-	"strconv"
 	"strings"
 )
 
@@ -29,6 +26,16 @@ var C2DMURLs = map[string]string{
 
 // C2DMClient ...
 type C2DMClient struct {
+	// RetryPolicy sets the backoff when the service gives no
+	// Retry-After, nil uses DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+	// Tokens is updated with the canonical and unregistered ids of each
+	// send if set.
+	Tokens TokenStore
+	// GCM sends the messages to the c2dm registration ids through gcm
+	// if set, see NewC2DMGCMClient. Tokens is updated for PlatformC2DM,
+	// the gcm client's for PlatformGCM.
+	GCM  *GCMClient
 	key  string
 	http *http.Client
 	url  string
@@ -70,7 +77,7 @@ func (c *C2DMResponse) UpdateToken() bool {
 	if c == nil {
 		return false
 	}
-	if c.Error == ErrRemoveToken || c.Error == ErrUpdateToken {
+	if isTokenError(c.Error) {
 		return true
 	}
 	return false
@@ -89,6 +96,17 @@ func NewC2DMClient(url, key string) (*C2DMClient, error) {
 	}, nil
 }
 
+// NewC2DMGCMClient returns a client sending c2dm messages through gcm,
+// which accepts the registration ids of c2dm devices. Canonical ids gcm
+// returns are reported with ErrUpdateToken and the response's
+// RegistrationID.
+func NewC2DMGCMClient(gcm *GCMClient) (*C2DMClient, error) {
+	if gcm == nil {
+		return nil, fmt.Errorf("gcm client not provided")
+	}
+	return &C2DMClient{GCM: gcm}, nil
+}
+
 // NewC2DMMessage ...
 func NewC2DMMessage(id string) *C2DMMessage {
 	return &C2DMMessage{
@@ -108,19 +126,25 @@ func (c *C2DMClient) Send(m *C2DMMessage) (*C2DMResponse, error) {
 	if len(m.Data) == 0 {
 		return nil, fmt.Errorf("no payload")
 	}
+	if c.GCM != nil {
+		return c.sendGCM(m)
+	}
 
 	data := url.Values{}
 	data.Set("registration_id", m.RegistrationID)
-	if m.CollapseKey == "" {
-		m.CollapseKey = "piglet"
+	collapseKey := m.CollapseKey
+	if collapseKey == "" {
+		// Required by c2dm.
+		collapseKey = "piglet"
 	}
-	data.Set("collapse_key", m.CollapseKey)
+	data.Set("collapse_key", collapseKey)
 
-	for k, v := range m.Data {
-		val, ok := v.(string)
-		if ok {
-			data.Set("data."+k, val)
-		}
+	values, err := c2dmData(m.Data)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range values {
+		data.Set("data."+k, v)
 	}
 
 	enc := data.Encode()
@@ -150,12 +174,7 @@ func (c *C2DMClient) Send(m *C2DMMessage) (*C2DMResponse, error) {
 	res := &C2DMResponse{RetryAfter: -1}
 	switch resp.StatusCode {
 	case 503, 500:
-		after := resp.Header.Get("Retry-After")
-		sleepFor, e := strconv.Atoi(after)
-		if e != nil {
-			return nil, e
-		}
-		res.RetryAfter = sleepFor
+		res.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
 		res.Error = ErrRetry
 		return res, res.Error
 	case 401:
@@ -178,15 +197,11 @@ func (c *C2DMClient) Send(m *C2DMMessage) (*C2DMResponse, error) {
 		switch errs[1] {
 		case "QuotaExceeded":
 			// Too many messages, retry after a while.
-			after := resp.Header.Get("Retry-After")
-			sleepFor, _ := strconv.Atoi(after)
-			res.RetryAfter = sleepFor
+			res.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
 			res.Error = ErrRetry
 		case "DeviceQuotaExceeded":
 			//  Too many messages sent by the sender to a specific device. Retry after a while.
-			after := resp.Header.Get("Retry-After")
-			sleepFor, _ := strconv.Atoi(after)
-			res.RetryAfter = sleepFor
+			res.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
 			res.Error = ErrRetry
 		case "InvalidRegistration":
 			res.Error = ErrRemoveToken
@@ -197,11 +212,86 @@ func (c *C2DMClient) Send(m *C2DMMessage) (*C2DMResponse, error) {
 		case "MissingCollapseKey":
 			res.Error = fmt.Errorf(errs[1])
 		default:
-			after := resp.Header.Get("Retry-After")
-			sleepFor, _ := strconv.Atoi(after)
-			res.RetryAfter = sleepFor
+			res.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
 			res.Error = ErrRetry
 		}
 	}
+	if res.Error == ErrRemoveToken {
+		err = storeTokens(c.Tokens, PlatformC2DM, tokenChange{old: m.RegistrationID})
+		if err != nil {
+			res.Error = err
+		}
+	}
+	return res, res.Error
+}
+
+// sendGCM sends the message as a gcm message to its registration id.
+func (c *C2DMClient) sendGCM(m *C2DMMessage) (*C2DMResponse, error) {
+	gm, err := m.GCM()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.GCM.Send(gm)
+	if resp == nil {
+		return nil, err
+	}
+
+	res := &C2DMResponse{
+		StatusCode: resp.StatusCode,
+		RetryAfter: resp.RetryAfter,
+		Error:      resp.Error,
+	}
+	var change []tokenChange
+	if len(resp.Results) == 1 {
+		switch result := resp.Results[0]; {
+		case result.Outcome() == GCMCanonical:
+			res.RegistrationID = result.RegistrationID
+			change = append(change, tokenChange{old: m.RegistrationID, new: result.RegistrationID})
+		case result.Outcome().Remove():
+			change = append(change, tokenChange{old: m.RegistrationID})
+		}
+	}
+	err = storeTokens(c.Tokens, PlatformC2DM, change...)
+	if err != nil {
+		res.Error = err
+	}
 	return res, res.Error
 }
+
+// GCM converts the message to a gcm message. The form encoded data
+// values of c2dm were strings, they're kept as strings in the json,
+// other values become their json encoding.
+func (g *C2DMMessage) GCM() (*GCMMessage, error) {
+	data, err := c2dmData(g.Data)
+	if err != nil {
+		return nil, err
+	}
+	m := &GCMMessage{
+		RegistrationIDs: []string{g.RegistrationID},
+		CollapseKey:     g.CollapseKey,
+		DelayWhileIdle:  g.DelayWhileIdle,
+		Data:            make(map[string]interface{}, len(data)),
+	}
+	for k, v := range data {
+		m.Data[k] = v
+	}
+	return m, nil
+}
+
+// c2dmData returns the data as strings, non string values are json
+// encoded.
+func c2dmData(data map[string]interface{}) (map[string]string, error) {
+	ret := make(map[string]string, len(data))
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			ret[k] = s
+			continue
+		}
+		j, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("data %s: %s", k, err)
+		}
+		ret[k] = string(j)
+	}
+	return ret, nil
+}
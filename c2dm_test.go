@@ -50,3 +50,105 @@ func TestC2DMSend(t *testing.T) {
 	}
 	t.Logf("%+v", r)
 }
+
+func TestC2DMMessageGCM(t *testing.T) {
+	m := NewC2DMMessage("abc")
+	m.Data = map[string]interface{}{
+		"s":   "b",
+		"n":   1.5,
+		"ok":  true,
+		"obj": map[string]interface{}{"x": 1},
+		"arr": []string{"a"},
+		"nil": nil,
+	}
+	g, err := m.GCM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"s": "b", "n": "1.5", "ok": "true", "obj": `{"x":1}`, "arr": `["a"]`, "nil": "null"}
+	for k, v := range want {
+		if g.Data[k] != v {
+			t.Errorf("expected %s %q got %#v", k, v, g.Data[k])
+		}
+	}
+	if len(g.RegistrationIDs) != 1 || g.RegistrationIDs[0] != "abc" || !g.DelayWhileIdle || g.CollapseKey != "" {
+		t.Fatalf("unexpected message %+v", g)
+	}
+
+	m.Data["bad"] = make(chan int)
+	if _, err = m.GCM(); err == nil {
+		t.Fatal("expected error for a value without json encoding")
+	}
+}
+
+func TestC2DMSendForm(t *testing.T) {
+	var form map[string][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		fmt.Fprintln(w, "id=0:1234")
+	}))
+	defer srv.Close()
+	c, _ := NewC2DMClient(srv.URL, "abc")
+
+	m := &C2DMMessage{RegistrationID: "abc", Data: map[string]interface{}{"a": "b", "n": 1}}
+	if _, err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if form["data.a"][0] != "b" || form["data.n"][0] != "1" || form["collapse_key"][0] != "piglet" {
+		t.Fatalf("unexpected form %v", form)
+	}
+	if m.CollapseKey != "" {
+		t.Fatal("message changed")
+	}
+}
+
+func TestC2DMSendGCM(t *testing.T) {
+	var got GCMMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = GCMMessage{}
+		json.NewDecoder(r.Body).Decode(&got)
+		switch got.RegistrationIDs[0] {
+		case "old":
+			fmt.Fprintln(w, `{"success":1,"canonical_ids":1,"results":[{"message_id":"1","registration_id":"new"}]}`)
+		case "gone":
+			fmt.Fprintln(w, `{"failure":1,"results":[{"error":"NotRegistered"}]}`)
+		default:
+			fmt.Fprintln(w, `{"success":1,"results":[{"message_id":"1"}]}`)
+		}
+	}))
+	defer srv.Close()
+	g, _ := NewGCMClient(srv.URL, "abc", "")
+	if _, err := NewC2DMGCMClient(nil); err == nil {
+		t.Fatal("expected error without gcm client")
+	}
+	c, _ := NewC2DMGCMClient(g)
+	s := NewMemoryTokenStore()
+	s.Add(PlatformC2DM, "old")
+	s.Add(PlatformC2DM, "gone")
+	c.Tokens = s
+
+	resp, err := c.Send(&C2DMMessage{RegistrationID: "abc", CollapseKey: "updates", Data: map[string]interface{}{"a": "b", "n": 2}})
+	if err != nil || resp.StatusCode != 200 || resp.Retry() != -1 {
+		t.Fatalf("unexpected response %v %+v", err, resp)
+	}
+	if got.Data["a"] != "b" || got.Data["n"] != "2" || got.CollapseKey != "updates" {
+		t.Fatalf("unexpected gcm message %+v", got)
+	}
+
+	resp, err = c.Send(&C2DMMessage{RegistrationID: "old", Data: map[string]interface{}{"a": "b"}})
+	if err != ErrUpdateToken || resp.RegistrationID != "new" || !resp.UpdateToken() {
+		t.Fatalf("expected canonical id got %v %+v", err, resp)
+	}
+	if current, _, _ := s.Lookup(PlatformC2DM, "old"); current != "new" {
+		t.Fatalf("expected old replaced got %q", current)
+	}
+
+	resp, err = c.Send(&C2DMMessage{RegistrationID: "gone", Data: map[string]interface{}{"a": "b"}})
+	if err != ErrRemoveToken || !resp.UpdateToken() {
+		t.Fatalf("expected remove token got %v %+v", err, resp)
+	}
+	if _, ok, _ := s.Lookup(PlatformC2DM, "gone"); ok {
+		t.Fatal("expected gone removed")
+	}
+}
@@ -0,0 +1,720 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CCSURLs map environment to the gcm cloud connection server, the xmpp
+// endpoint that also receives upstream messages and delivery receipts.
+var CCSURLs = map[string]string{
+	"testing":     "localhost:5235",
+	"development": "fcm-xmpp.googleapis.com:5236",
+	"staging":     "fcm-xmpp.googleapis.com:5236",
+	"production":  "fcm-xmpp.googleapis.com:5235",
+}
+
+// CCSMaxPending is the most messages a connection may have sent
+// without an ack or nack from CCS.
+const CCSMaxPending = 100
+
+const (
+	ccsDomain    = "gcm.googleapis.com"
+	ccsStream    = `<stream:stream to="gcm.googleapis.com" version="1.0" xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams">`
+	ccsTimeout   = 30 * time.Second
+	ccsKeepAlive = time.Minute
+	// ccsResends is how many times a message nacked because the
+	// connection is draining is sent on a new one.
+	ccsResends = 3
+)
+
+var (
+	errCCSClosed   = fmt.Errorf("ccs client closed")
+	errCCSDraining = fmt.Errorf("ccs connection draining")
+
+	ccsMessageID     int64
+	ccsMessagePrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+)
+
+// CCSMessage is a downstream message sent through CCS, the fields are
+// those of GCMMessage for a single target.
+type CCSMessage struct {
+	// To is a registration id, a topic or a notification key.
+	To        string `json:"to,omitempty"`
+	Condition string `json:"condition,omitempty"`
+	// MessageID is unique per message, set by Send if empty.
+	MessageID                string                 `json:"message_id"`
+	CollapseKey              string                 `json:"collapse_key,omitempty"`
+	Data                     map[string]interface{} `json:"data,omitempty"`
+	Notification             *GCMNotification       `json:"notification,omitempty"`
+	Priority                 string                 `json:"priority,omitempty"`
+	ContentAvailable         bool                   `json:"content_available,omitempty"`
+	TimeToLive               int                    `json:"time_to_live,omitempty"`
+	DryRun                   bool                   `json:"dry_run,omitempty"`
+	DeliveryReceiptRequested bool                   `json:"delivery_receipt_requested,omitempty"`
+}
+
+// Bytes implements interface Message.
+func (m *CCSMessage) Bytes() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Validate checks the target, priority and time to live.
+func (m *CCSMessage) Validate() error {
+	if m.To == "" && m.Condition == "" {
+		return fmt.Errorf("to or condition required")
+	}
+	return (&GCMMessage{
+		To:         m.To,
+		Condition:  m.Condition,
+		Data:       m.Data,
+		Priority:   m.Priority,
+		TimeToLive: m.TimeToLive,
+	}).Validate()
+}
+
+// CCSResponse is the ack or nack of a CCSMessage.
+type CCSResponse struct {
+	MessageID string `json:"message_id"`
+	// From is the registration id the message was sent to.
+	From string `json:"from"`
+	// RegistrationID is the canonical id to send to instead of From.
+	RegistrationID string `json:"registration_id,omitempty"`
+	// ErrorCode and ErrorDescription are set for a nack.
+	ErrorCode        string `json:"error_code,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	// set to -1 initially, if >= 0 then retry.
+	RetryAfter   int   `json:"retry_after"`
+	Error        error `json:"error"`
+	ResponseTime int64 `json:"response_time"` // time in milliseconds
+}
+
+// Bytes implements interface Response.
+func (r *CCSResponse) Bytes() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Retry implements interface Response.
+func (r *CCSResponse) Retry() int {
+	return r.RetryAfter
+}
+
+// UpdateToken implements interface Response.
+func (r *CCSResponse) UpdateToken() bool {
+	if r == nil {
+		return false
+	}
+	return isTokenError(r.Error)
+}
+
+// CCSUpstream is a message a device sent to the app server.
+type CCSUpstream struct {
+	From      string            `json:"from"`
+	Category  string            `json:"category"`
+	MessageID string            `json:"message_id"`
+	Data      map[string]string `json:"data"`
+}
+
+// CCSReceipt reports a message was delivered to the device, they're
+// sent for messages with DeliveryReceiptRequested.
+type CCSReceipt struct {
+	MessageID         string `json:"message_id"`
+	OriginalMessageID string `json:"original_message_id"`
+	// Status is MESSAGE_SENT_TO_DEVICE.
+	Status         string `json:"message_status"`
+	RegistrationID string `json:"device_registration_id"`
+	// SentTimestamp is in milliseconds.
+	SentTimestamp string `json:"message_sent_timestamp"`
+	Category      string `json:"category"`
+}
+
+// CCSUpstreamHandler is called with the messages devices send.
+type CCSUpstreamHandler func(m *CCSUpstream)
+
+// CCSReceiptHandler is called with the delivery receipts of sent
+// messages.
+type CCSReceiptHandler func(r *CCSReceipt)
+
+// ccsPacket is anything CCS sends in a message stanza.
+type ccsPacket struct {
+	MessageType      string            `json:"message_type"`
+	MessageID        string            `json:"message_id"`
+	From             string            `json:"from"`
+	Category         string            `json:"category"`
+	Data             map[string]string `json:"data"`
+	RegistrationID   string            `json:"registration_id"`
+	Error            string            `json:"error"`
+	ErrorDescription string            `json:"error_description"`
+	ControlType      string            `json:"control_type"`
+}
+
+// CCSClient sends messages over a persistent xmpp session with CCS
+// and receives upstream messages and delivery receipts on it.
+type CCSClient struct {
+	SenderID           string
+	InsecureSkipVerify bool
+	// Timeout is how long Send waits for an ack, 30s if 0.
+	Timeout time.Duration
+	// OnUpstream and OnReceipt are called from the connection's reader,
+	// the message is acked when they return. A client with either set
+	// reconnects when its session is lost.
+	OnUpstream CCSUpstreamHandler
+	OnReceipt  CCSReceiptHandler
+	// RetryPolicy sets RetryAfter of retryable nacks and the backoff of
+	// reconnects, nil uses DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+	// Tokens is updated with the canonical and unregistered ids of
+	// each send if set.
+	Tokens TokenStore
+	addr   string
+	key    string
+
+	mu     sync.Mutex
+	conn   *ccsConn
+	closed bool
+}
+
+// NewCCSClient returns a client for the sender authenticating with the
+// api key, it connects on Connect or the first Send.
+func NewCCSClient(addr, senderID, key string) (*CCSClient, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("address not provided")
+	}
+	if senderID == "" || key == "" {
+		return nil, fmt.Errorf("sender id and key required")
+	}
+	return &CCSClient{
+		SenderID: senderID,
+		addr:     addr,
+		key:      key,
+	}, nil
+}
+
+// Connect opens the session if it isn't. Send connects when needed, but
+// upstream messages only arrive on an open session.
+func (c *CCSClient) Connect() error {
+	_, err := c.active()
+	return err
+}
+
+// Close ends the session, messages waiting for an ack fail.
+func (c *CCSClient) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	cc := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if cc == nil {
+		return nil
+	}
+	return cc.close(errCCSClosed)
+}
+
+// Send writes the message on the session and waits for CCS to ack it.
+// At most CCSMaxPending messages wait at a time, the others block until
+// there's room. Messages a draining connection nacks are sent again on
+// a new connection.
+func (c *CCSClient) Send(m *CCSMessage) (*CCSResponse, error) {
+	err := m.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if m.MessageID == "" {
+		m.MessageID = fmt.Sprintf("%s-%d", ccsMessagePrefix, atomic.AddInt64(&ccsMessageID, 1))
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = ccsTimeout
+	}
+
+	start := time.Now()
+	ret := &CCSResponse{MessageID: m.MessageID, RetryAfter: -1}
+	var p *ccsPacket
+	for attempt := 0; ; attempt++ {
+		cc, err := c.active()
+		if err != nil {
+			return nil, err
+		}
+		p, err = cc.send(m.MessageID, body, timeout)
+		draining := err == errCCSDraining || (p != nil && p.Error == "CONNECTION_DRAINING")
+		if draining && attempt < ccsResends {
+			continue
+		}
+		if err == errCCSClosed {
+			return nil, err
+		}
+		if err != nil {
+			// Lost with the connection or not acked in time.
+			ret.RetryAfter = c.RetryPolicy.RetryAfter(nil)
+			ret.Error = ErrRetry
+			ret.ResponseTime = time.Since(start).Nanoseconds() / 1000000
+			return ret, ret.Error
+		}
+		break
+	}
+	ret.ResponseTime = time.Since(start).Nanoseconds() / 1000000
+	ret.From = p.From
+
+	if p.MessageType == "ack" {
+		if p.RegistrationID == "" {
+			return ret, nil
+		}
+		ret.RegistrationID = p.RegistrationID
+		ret.Error = ErrUpdateToken
+		err = storeTokens(c.Tokens, PlatformGCM, tokenChange{old: m.To, new: p.RegistrationID})
+		if err != nil {
+			ret.Error = err
+		}
+		return ret, ret.Error
+	}
+
+	ret.ErrorCode = p.Error
+	ret.ErrorDescription = p.ErrorDescription
+	switch p.Error {
+	case "BAD_REGISTRATION", "DEVICE_UNREGISTERED":
+		ret.Error = ErrRemoveToken
+		err = storeTokens(c.Tokens, PlatformGCM, tokenChange{old: m.To})
+		if err != nil {
+			ret.Error = err
+		}
+	case "SERVICE_UNAVAILABLE", "INTERNAL_SERVER_ERROR", "DEVICE_MESSAGE_RATE_EXCEEDED", "TOPICS_MESSAGE_RATE_EXCEEDED", "CONNECTION_DRAINING":
+		ret.RetryAfter = c.RetryPolicy.RetryAfter(nil)
+		ret.Error = ErrRetry
+	default:
+		ret.Error = fmt.Errorf("ccs %s %s", p.Error, p.ErrorDescription)
+	}
+	return ret, ret.Error
+}
+
+// active returns the connection messages are sent on, a new one if it
+// was closed or is draining.
+func (c *CCSClient) active() (*ccsConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errCCSClosed
+	}
+	if c.conn != nil && c.conn.usable() {
+		return c.conn, nil
+	}
+	cc, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = cc
+	return cc, nil
+}
+
+// lost reconnects after the active connection closed when upstream
+// messages are handled, backing off following the RetryPolicy.
+func (c *CCSClient) lost(cc *ccsConn) {
+	c.mu.Lock()
+	active := c.conn == cc && !c.closed
+	c.mu.Unlock()
+	if !active || (c.OnUpstream == nil && c.OnReceipt == nil) {
+		return
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		delay, ok := c.RetryPolicy.Next(attempt, start, 0)
+		if !ok {
+			return
+		}
+		time.Sleep(delay)
+		_, err := c.active()
+		if err == nil || err == errCCSClosed {
+			return
+		}
+	}
+}
+
+// dial connects and authenticates a new session.
+func (c *CCSClient) dial() (*ccsConn, error) {
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 20 * time.Second}, "tcp", c.addr, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cc := &ccsConn{
+		client:  c,
+		conn:    conn,
+		dec:     xml.NewDecoder(conn),
+		window:  make(chan struct{}, CCSMaxPending),
+		drain:   make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: make(map[string]chan *ccsPacket),
+	}
+	conn.SetDeadline(time.Now().Add(ccsTimeout))
+	err = cc.handshake(c.SenderID, c.key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	go cc.read()
+	go cc.keepAlive()
+	return cc, nil
+}
+
+// ccsConn is a session with CCS.
+type ccsConn struct {
+	client *CCSClient
+	conn   net.Conn
+	dec    *xml.Decoder
+	wmu    sync.Mutex
+	// window holds a slot for each message waiting for its ack.
+	window chan struct{}
+	// drain is closed when CCS asks for a new connection, done when
+	// the connection is closed.
+	drain chan struct{}
+	done  chan struct{}
+
+	// mu guards the acks waited for between send and the reader.
+	mu       sync.Mutex
+	pending  map[string]chan *ccsPacket
+	draining bool
+	err      error
+}
+
+// ccsFeatures are the stream features CCS offers.
+type ccsFeatures struct {
+	Mechanisms []string `xml:"mechanisms>mechanism"`
+}
+
+// handshake authenticates with sasl PLAIN and binds a resource.
+func (cc *ccsConn) handshake(senderID, key string) error {
+	features, err := cc.open()
+	if err != nil {
+		return err
+	}
+	plain := false
+	for _, m := range features.Mechanisms {
+		plain = plain || m == "PLAIN"
+	}
+	if !plain {
+		return fmt.Errorf("ccs PLAIN authentication not offered %v", features.Mechanisms)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00" + senderID + "@" + ccsDomain + "\x00" + key))
+	err = cc.write(`<auth mechanism="PLAIN" xmlns="urn:ietf:params:xml:ns:xmpp-sasl">` + auth + `</auth>`)
+	if err != nil {
+		return err
+	}
+	start, err := cc.element()
+	if err != nil {
+		return err
+	}
+	if start.Name.Local != "success" {
+		return fmt.Errorf("ccs authentication failed for %s", senderID)
+	}
+	cc.dec.Skip()
+
+	_, err = cc.open()
+	if err != nil {
+		return err
+	}
+	err = cc.write(`<iq type="set" id="bind"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"></bind></iq>`)
+	if err != nil {
+		return err
+	}
+	start, err = cc.element()
+	if err != nil {
+		return err
+	}
+	iq := struct {
+		Type string `xml:"type,attr"`
+		JID  string `xml:"bind>jid"`
+	}{}
+	err = cc.dec.DecodeElement(&iq, &start)
+	if err != nil {
+		return err
+	}
+	if start.Name.Local != "iq" || iq.Type != "result" {
+		return fmt.Errorf("ccs bind failed %s %s", start.Name.Local, iq.Type)
+	}
+	return nil
+}
+
+// open starts a stream and returns its features.
+func (cc *ccsConn) open() (*ccsFeatures, error) {
+	err := cc.write(ccsStream)
+	if err != nil {
+		return nil, err
+	}
+	start, err := cc.element()
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "stream" {
+		return nil, fmt.Errorf("ccs unexpected %s, expected stream", start.Name.Local)
+	}
+	start, err = cc.element()
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "features" {
+		return nil, fmt.Errorf("ccs unexpected %s, expected features", start.Name.Local)
+	}
+	features := &ccsFeatures{}
+	err = cc.dec.DecodeElement(features, &start)
+	return features, err
+}
+
+// element returns the next start element, io.EOF once the stream ends.
+func (cc *ccsConn) element() (xml.StartElement, error) {
+	for {
+		t, err := cc.dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			if t.Name.Local == "stream" {
+				return xml.StartElement{}, io.EOF
+			}
+		}
+	}
+}
+
+// next returns the json of the next message stanza, other stanzas are
+// skipped.
+func (cc *ccsConn) next() (*ccsPacket, error) {
+	for {
+		start, err := cc.element()
+		if err != nil {
+			return nil, err
+		}
+		if start.Name.Local != "message" {
+			cc.dec.Skip()
+			continue
+		}
+		stanza := struct {
+			GCM string `xml:"gcm"`
+		}{}
+		err = cc.dec.DecodeElement(&stanza, &start)
+		if err != nil {
+			return nil, err
+		}
+		p := &ccsPacket{}
+		if json.Unmarshal([]byte(stanza.GCM), p) != nil {
+			continue
+		}
+		return p, nil
+	}
+}
+
+// read dispatches what CCS sends until the connection closes.
+func (cc *ccsConn) read() {
+	for {
+		p, err := cc.next()
+		if err != nil {
+			cc.close(err)
+			cc.client.lost(cc)
+			return
+		}
+		switch p.MessageType {
+		case "ack", "nack":
+			cc.mu.Lock()
+			ch, ok := cc.pending[p.MessageID]
+			if ok {
+				delete(cc.pending, p.MessageID)
+				<-cc.window
+			}
+			drained := cc.draining && len(cc.pending) == 0
+			cc.mu.Unlock()
+			if ok {
+				ch <- p
+			}
+			if drained {
+				cc.close(errCCSDraining)
+				return
+			}
+		case "control":
+			if p.ControlType != "CONNECTION_DRAINING" {
+				continue
+			}
+			cc.mu.Lock()
+			if !cc.draining {
+				cc.draining = true
+				close(cc.drain)
+			}
+			drained := len(cc.pending) == 0
+			cc.mu.Unlock()
+			if cc.client.OnUpstream != nil || cc.client.OnReceipt != nil {
+				go cc.client.active()
+			}
+			if drained {
+				cc.close(errCCSDraining)
+				return
+			}
+		case "receipt":
+			if cc.client.OnReceipt != nil {
+				r := &CCSReceipt{
+					MessageID:         p.MessageID,
+					OriginalMessageID: p.Data["original_message_id"],
+					Status:            p.Data["message_status"],
+					RegistrationID:    p.Data["device_registration_id"],
+					SentTimestamp:     p.Data["message_sent_timestamp"],
+					Category:          p.Category,
+				}
+				cc.client.OnReceipt(r)
+			}
+			cc.ack(p)
+		case "":
+			if cc.client.OnUpstream != nil {
+				cc.client.OnUpstream(&CCSUpstream{
+					From:      p.From,
+					Category:  p.Category,
+					MessageID: p.MessageID,
+					Data:      p.Data,
+				})
+			}
+			cc.ack(p)
+		}
+	}
+}
+
+// usable reports whether messages can be sent on the connection.
+func (cc *ccsConn) usable() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return !cc.draining && cc.err == nil
+}
+
+// send writes the message and waits for its ack or nack.
+func (cc *ccsConn) send(id string, body []byte, timeout time.Duration) (*ccsPacket, error) {
+	select {
+	case cc.window <- struct{}{}:
+	case <-cc.drain:
+		return nil, errCCSDraining
+	case <-cc.done:
+		return nil, cc.closeErr()
+	}
+	ch := make(chan *ccsPacket, 1)
+	cc.mu.Lock()
+	if cc.draining || cc.err != nil {
+		err := cc.err
+		if err == nil {
+			err = errCCSDraining
+		}
+		<-cc.window
+		cc.mu.Unlock()
+		return nil, err
+	}
+	cc.pending[id] = ch
+	cc.mu.Unlock()
+
+	err := cc.write(ccsStanza(body))
+	if err != nil {
+		cc.forget(id)
+		cc.close(err)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case p := <-ch:
+		return p, nil
+	case <-cc.done:
+		cc.forget(id)
+		return nil, cc.closeErr()
+	case <-timer.C:
+		cc.forget(id)
+		return nil, fmt.Errorf("ccs no ack for %s in %s", id, timeout)
+	}
+}
+
+// forget stops waiting for the ack of id.
+func (cc *ccsConn) forget(id string) {
+	cc.mu.Lock()
+	if _, ok := cc.pending[id]; ok {
+		delete(cc.pending, id)
+		<-cc.window
+	}
+	cc.mu.Unlock()
+}
+
+// ack acknowledges an upstream message or receipt.
+func (cc *ccsConn) ack(p *ccsPacket) error {
+	body, err := json.Marshal(map[string]string{
+		"to":           p.From,
+		"message_id":   p.MessageID,
+		"message_type": "ack",
+	})
+	if err != nil {
+		return err
+	}
+	return cc.write(ccsStanza(body))
+}
+
+// keepAlive writes whitespace pings until the connection closes.
+func (cc *ccsConn) keepAlive() {
+	ticker := time.NewTicker(ccsKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cc.write(" ")
+		case <-cc.done:
+			return
+		}
+	}
+}
+
+func (cc *ccsConn) write(s string) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cc.conn.SetWriteDeadline(time.Now().Add(ccsTimeout))
+	_, err := io.WriteString(cc.conn, s)
+	return err
+}
+
+// close ends the stream once, the error is returned to the senders
+// still waiting.
+func (cc *ccsConn) close(err error) error {
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return nil
+	}
+	cc.err = err
+	close(cc.done)
+	cc.mu.Unlock()
+	cc.write("</stream:stream>")
+	return cc.conn.Close()
+}
+
+func (cc *ccsConn) closeErr() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err
+}
+
+// ccsStanza wraps the json in a message stanza.
+func ccsStanza(body []byte) string {
+	b := bytes.NewBufferString(`<message id=""><gcm xmlns="google:mobile:data">`)
+	xml.EscapeText(b, body)
+	b.WriteString(`</gcm></message>`)
+	return b.String()
+}
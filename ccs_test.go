@@ -0,0 +1,399 @@
+package hermes
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ccsFakeServer is an in process CCS for sender 1234 with key abc. It
+// answers downstream messages by their to: "gone" is unregistered,
+// "old" has canonical id "new", "busy" is unavailable, "bad" is invalid
+// json and "drain" is acked after asking for a new connection. While
+// hold is set answers wait for release.
+type ccsFakeServer struct {
+	net.Listener
+	// acks are the message ids the client acked.
+	acks chan string
+
+	mu       sync.Mutex
+	conns    []*ccsFakeConn
+	received []*CCSMessage
+	hold     bool
+	held     []func()
+}
+
+type ccsFakeConn struct {
+	net.Conn
+	wmu sync.Mutex
+}
+
+func (c *ccsFakeConn) write(s string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	io.WriteString(c, s)
+}
+
+func (c *ccsFakeConn) message(format string, args ...interface{}) {
+	c.write(ccsStanza([]byte(fmt.Sprintf(format, args...))))
+}
+
+var CCSServer *ccsFakeServer
+
+func init() {
+	crt, err := tls.X509KeyPair([]byte(APNSCertMock), []byte(APNSKeyMock))
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{crt}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	CCSServer = &ccsFakeServer{Listener: l, acks: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go CCSServer.serve(&ccsFakeConn{Conn: conn})
+		}
+	}()
+}
+
+// reset forgets the sessions and messages received and stops holding.
+func (s *ccsFakeServer) reset() {
+	s.mu.Lock()
+	s.conns = nil
+	s.received = nil
+	s.hold = false
+	s.held = nil
+	s.mu.Unlock()
+	for len(s.acks) > 0 {
+		<-s.acks
+	}
+}
+
+func (s *ccsFakeServer) serve(conn *ccsFakeConn) {
+	defer conn.Close()
+	dec := xml.NewDecoder(conn)
+	element := func() (xml.StartElement, error) {
+		for {
+			t, err := dec.Token()
+			if err != nil {
+				return xml.StartElement{}, err
+			}
+			if start, ok := t.(xml.StartElement); ok {
+				return start, nil
+			}
+		}
+	}
+	header := `<stream:stream from="gcm.googleapis.com" id="1" version="1.0" xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams">`
+
+	if start, err := element(); err != nil || start.Name.Local != "stream" {
+		return
+	}
+	conn.write(header + `<stream:features><mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>X-OAUTH2</mechanism><mechanism>PLAIN</mechanism></mechanisms></stream:features>`)
+	start, err := element()
+	if err != nil {
+		return
+	}
+	auth := struct {
+		Mechanism string `xml:"mechanism,attr"`
+		Value     string `xml:",chardata"`
+	}{}
+	dec.DecodeElement(&auth, &start)
+	plain, _ := base64.StdEncoding.DecodeString(auth.Value)
+	if auth.Mechanism != "PLAIN" || string(plain) != "\x001234@gcm.googleapis.com\x00abc" {
+		conn.write(`<failure xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><not-authorized/></failure></stream:stream>`)
+		return
+	}
+	conn.write(`<success xmlns="urn:ietf:params:xml:ns:xmpp-sasl"/>`)
+	if start, err := element(); err != nil || start.Name.Local != "stream" {
+		return
+	}
+	conn.write(header + `<stream:features><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/><session xmlns="urn:ietf:params:xml:ns:xmpp-session"/></stream:features>`)
+	if start, err = element(); err != nil || start.Name.Local != "iq" {
+		return
+	}
+	dec.Skip()
+	conn.write(`<iq type="result" id="bind"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><jid>1234@gcm.googleapis.com/hermes</jid></bind></iq>`)
+
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+
+	for {
+		start, err := element()
+		if err != nil {
+			return
+		}
+		if start.Name.Local != "message" {
+			dec.Skip()
+			continue
+		}
+		stanza := struct {
+			GCM string `xml:"gcm"`
+		}{}
+		dec.DecodeElement(&stanza, &start)
+		p := ccsPacket{}
+		json.Unmarshal([]byte(stanza.GCM), &p)
+		if p.MessageType == "ack" {
+			s.acks <- p.MessageID
+			continue
+		}
+		m := &CCSMessage{}
+		json.Unmarshal([]byte(stanza.GCM), m)
+		s.answer(conn, m)
+	}
+}
+
+func (s *ccsFakeServer) answer(conn *ccsFakeConn, m *CCSMessage) {
+	answer := func() {
+		switch {
+		case strings.HasPrefix(m.To, "gone"):
+			conn.message(`{"message_type":"nack","from":%q,"message_id":%q,"error":"DEVICE_UNREGISTERED","error_description":"Device unregistered"}`, m.To, m.MessageID)
+		case strings.HasPrefix(m.To, "busy"):
+			conn.message(`{"message_type":"nack","from":%q,"message_id":%q,"error":"SERVICE_UNAVAILABLE"}`, m.To, m.MessageID)
+		case strings.HasPrefix(m.To, "bad"):
+			conn.message(`{"message_type":"nack","from":%q,"message_id":%q,"error":"INVALID_JSON","error_description":"Invalid value"}`, m.To, m.MessageID)
+		case strings.HasPrefix(m.To, "old"):
+			conn.message(`{"message_type":"ack","from":%q,"message_id":%q,"registration_id":"new"}`, m.To, m.MessageID)
+		case strings.HasPrefix(m.To, "drain"):
+			conn.message(`{"message_type":"control","control_type":"CONNECTION_DRAINING"}`)
+			conn.message(`{"message_type":"ack","from":%q,"message_id":%q}`, m.To, m.MessageID)
+		default:
+			conn.message(`{"message_type":"ack","from":%q,"message_id":%q}`, m.To, m.MessageID)
+			if m.DeliveryReceiptRequested {
+				conn.message(`{"message_type":"receipt","from":"gcm.googleapis.com","category":"com.example","message_id":"dr2:%s","data":{"message_status":"MESSAGE_SENT_TO_DEVICE","original_message_id":%q,"device_registration_id":%q,"message_sent_timestamp":"1430277821658"}}`, m.MessageID, m.MessageID, m.To)
+			}
+		}
+	}
+	s.mu.Lock()
+	s.received = append(s.received, m)
+	if s.hold {
+		s.held = append(s.held, answer)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	answer()
+}
+
+// release answers the held messages and stops holding.
+func (s *ccsFakeServer) release() {
+	s.mu.Lock()
+	held := s.held
+	s.held = nil
+	s.hold = false
+	s.mu.Unlock()
+	for _, answer := range held {
+		answer()
+	}
+}
+
+// session returns the i'th session.
+func (s *ccsFakeServer) session(i int) *ccsFakeConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns[i]
+}
+
+// message returns the i'th message received.
+func (s *ccsFakeServer) message(i int) *CCSMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received[i]
+}
+
+func (s *ccsFakeServer) counts() (conns, received int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns), len(s.received)
+}
+
+func TestNewCCSClient(t *testing.T) {
+	if (*CCSResponse)(nil).UpdateToken() {
+		t.Fatal("nil response updates no token")
+	}
+	if _, err := NewCCSClient("", "1234", "abc"); err == nil {
+		t.Fatal("expected error without address")
+	}
+	if _, err := NewCCSClient(CCSURLs["testing"], "", "abc"); err == nil {
+		t.Fatal("expected error without sender id")
+	}
+	c, _ := NewCCSClient(CCSServer.Addr().String(), "1234", "wrong")
+	c.InsecureSkipVerify = true
+	if err := c.Connect(); err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Fatalf("expected authentication error got %v", err)
+	}
+	if _, err := c.Send(&CCSMessage{}); err == nil {
+		t.Fatal("expected error without a target")
+	}
+}
+
+func TestCCSSend(t *testing.T) {
+	CCSServer.reset()
+	c, _ := NewCCSClient(CCSServer.Addr().String(), "1234", "abc")
+	c.InsecureSkipVerify = true
+	defer c.Close()
+	store := NewMemoryTokenStore()
+	for _, token := range []string{"old", "gone"} {
+		store.Add(PlatformGCM, token)
+	}
+	c.Tokens = store
+
+	m := &CCSMessage{To: "abc", Data: map[string]interface{}{"a": "b"}, Notification: &GCMNotification{Title: "hello"}}
+	resp, err := c.Send(m)
+	if err != nil || m.MessageID == "" || resp.MessageID != m.MessageID || resp.From != "abc" || resp.Retry() != -1 {
+		t.Fatalf("unexpected response %v %+v", err, resp)
+	}
+	if got := CCSServer.message(0); got.Data["a"] != "b" || got.Notification.Title != "hello" {
+		t.Fatalf("unexpected message %+v", got)
+	}
+
+	resp, err = c.Send(&CCSMessage{To: "old"})
+	if err != ErrUpdateToken || resp.RegistrationID != "new" || !resp.UpdateToken() {
+		t.Fatalf("expected canonical id got %v %+v", err, resp)
+	}
+	if current, _, _ := store.Lookup(PlatformGCM, "old"); current != "new" {
+		t.Fatalf("expected old replaced got %q", current)
+	}
+
+	resp, err = c.Send(&CCSMessage{To: "gone"})
+	if err != ErrRemoveToken || resp.ErrorCode != "DEVICE_UNREGISTERED" || !resp.UpdateToken() {
+		t.Fatalf("expected remove token got %v %+v", err, resp)
+	}
+	if _, ok, _ := store.Lookup(PlatformGCM, "gone"); ok {
+		t.Fatal("expected gone removed")
+	}
+
+	resp, err = c.Send(&CCSMessage{To: "busy"})
+	if err != ErrRetry || resp.Retry() < 0 {
+		t.Fatalf("expected retry got %v %+v", err, resp)
+	}
+
+	resp, err = c.Send(&CCSMessage{To: "bad"})
+	if err == nil || err == ErrRetry || resp.ErrorCode != "INVALID_JSON" || resp.Retry() != -1 {
+		t.Fatalf("expected invalid json got %v %+v", err, resp)
+	}
+
+	if conns, _ := CCSServer.counts(); conns != 1 {
+		t.Fatalf("expected a single session got %d", conns)
+	}
+	c.Close()
+	if _, err = c.Send(&CCSMessage{To: "abc"}); err != errCCSClosed {
+		t.Fatalf("expected closed got %v", err)
+	}
+}
+
+func TestCCSWindow(t *testing.T) {
+	CCSServer.reset()
+	c, _ := NewCCSClient(CCSServer.Addr().String(), "1234", "abc")
+	c.InsecureSkipVerify = true
+	defer c.Close()
+	CCSServer.mu.Lock()
+	CCSServer.hold = true
+	CCSServer.mu.Unlock()
+
+	n := CCSMaxPending + 50
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			_, err := c.Send(&CCSMessage{To: fmt.Sprintf("abc%d", i)})
+			errs <- err
+		}(i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, received := CCSServer.counts(); received < CCSMaxPending; _, received = CCSServer.counts() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages got %d", CCSMaxPending, received)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, received := CCSServer.counts(); received != CCSMaxPending {
+		t.Fatalf("expected at most %d unacked messages got %d", CCSMaxPending, received)
+	}
+	CCSServer.release()
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, received := CCSServer.counts(); received != n {
+		t.Fatalf("expected %d messages got %d", n, received)
+	}
+}
+
+func TestCCSDraining(t *testing.T) {
+	CCSServer.reset()
+	c, _ := NewCCSClient(CCSServer.Addr().String(), "1234", "abc")
+	c.InsecureSkipVerify = true
+	defer c.Close()
+
+	if _, err := c.Send(&CCSMessage{To: "drain"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Send(&CCSMessage{To: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if conns, _ := CCSServer.counts(); conns != 2 {
+		t.Fatalf("expected a new connection after draining got %d", conns)
+	}
+}
+
+func TestCCSUpstream(t *testing.T) {
+	CCSServer.reset()
+	c, _ := NewCCSClient(CCSServer.Addr().String(), "1234", "abc")
+	c.InsecureSkipVerify = true
+	c.RetryPolicy = &RetryPolicy{Base: time.Millisecond, MaxAttempts: 5}
+	defer c.Close()
+	upstream := make(chan *CCSUpstream, 1)
+	receipts := make(chan *CCSReceipt, 1)
+	c.OnUpstream = func(m *CCSUpstream) { upstream <- m }
+	c.OnReceipt = func(r *CCSReceipt) { receipts <- r }
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	CCSServer.session(0).message(`{"from":"device","category":"com.example","message_id":"up-1","data":{"a":"b"}}`)
+	m := <-upstream
+	if m.From != "device" || m.Category != "com.example" || m.Data["a"] != "b" {
+		t.Fatalf("unexpected upstream %+v", m)
+	}
+	if id := <-CCSServer.acks; id != "up-1" {
+		t.Fatalf("expected up-1 acked got %s", id)
+	}
+
+	sent := &CCSMessage{To: "abc", DeliveryReceiptRequested: true}
+	if _, err := c.Send(sent); err != nil {
+		t.Fatal(err)
+	}
+	r := <-receipts
+	if r.OriginalMessageID != sent.MessageID || r.Status != "MESSAGE_SENT_TO_DEVICE" || r.RegistrationID != "abc" {
+		t.Fatalf("unexpected receipt %+v", r)
+	}
+	if id := <-CCSServer.acks; id != "dr2:"+sent.MessageID {
+		t.Fatalf("expected receipt acked got %s", id)
+	}
+
+	// A lost session is connected again to keep receiving.
+	CCSServer.session(0).Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for conns, _ := CCSServer.counts(); conns < 2; conns, _ = CCSServer.counts() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client to reconnect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
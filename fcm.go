@@ -0,0 +1,355 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// FCMURLs map environment to the fcm api url.
+var FCMURLs = map[string]string{
+	"testing":     "http://localhost:5557",
+	"development": "https://fcm.googleapis.com",
+	"staging":     "https://fcm.googleapis.com",
+	"production":  "https://fcm.googleapis.com",
+}
+
+// FCMPath is the send endpoint of the HTTP v1 api for a project.
+const FCMPath = "/v1/projects/%s/messages:send"
+
+// FCMScope is the oauth2 scope needed to send messages.
+const FCMScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// FCMTokenURI is used if the service account has no token_uri.
+var FCMTokenURI = "https://oauth2.googleapis.com/token"
+
+// FCMServiceAccount is the service account key json downloaded from
+// the firebase or google cloud console.
+type FCMServiceAccount struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// FCMToken exchanges signed assertions of a service account for oauth2
+// access tokens, caching them until shortly before they expire.
+type FCMToken struct {
+	Account *FCMServiceAccount
+	key     *rsa.PrivateKey
+	oauthToken
+}
+
+// NewFCMToken parses the service account key json.
+func NewFCMToken(account []byte) (*FCMToken, error) {
+	a := &FCMServiceAccount{}
+	err := json.Unmarshal(account, a)
+	if err != nil {
+		return nil, err
+	}
+	if a.ClientEmail == "" || a.PrivateKey == "" {
+		return nil, fmt.Errorf("client_email and private_key required")
+	}
+	if a.TokenURI == "" {
+		a.TokenURI = FCMTokenURI
+	}
+	key, err := parseRSAPrivateKey([]byte(a.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return &FCMToken{
+		Account:    a,
+		key:        key,
+		oauthToken: newOAuthToken(),
+	}, nil
+}
+
+// AccessToken returns the cached access token, exchanging a new
+// assertion once it is about to expire.
+func (t *FCMToken) AccessToken() (string, error) {
+	return t.accessToken(t.Account.TokenURI, func(now time.Time) (url.Values, error) {
+		header := map[string]string{"alg": "RS256", "typ": "JWT", "kid": t.Account.PrivateKeyID}
+		claims := map[string]interface{}{
+			"iss":   t.Account.ClientEmail,
+			"scope": FCMScope,
+			"aud":   t.Account.TokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		}
+		assertion, err := encodeJWT(header, claims, rs256Signer(t.key))
+		if err != nil {
+			return nil, err
+		}
+		form := url.Values{}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+		return form, nil
+	})
+}
+
+// FCMMessage https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages
+// One of Token, Topic or Condition is the target.
+type FCMMessage struct {
+	Token        string            `json:"token,omitempty"`
+	Topic        string            `json:"topic,omitempty"`
+	Condition    string            `json:"condition,omitempty"`
+	Notification *FCMNotification  `json:"notification,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+	Android      *FCMAndroidConfig `json:"android,omitempty"`
+	APNS         *FCMAPNSConfig    `json:"apns,omitempty"`
+	Webpush      *FCMWebpushConfig `json:"webpush,omitempty"`
+}
+
+// FCMNotification is shown on every platform.
+type FCMNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	Image string `json:"image,omitempty"`
+}
+
+// FCMAndroidConfig overrides the message for android devices.
+type FCMAndroidConfig struct {
+	CollapseKey string `json:"collapse_key,omitempty"`
+	// Priority is "normal" or "high".
+	Priority string `json:"priority,omitempty"`
+	// TTL is a duration in seconds such as "3.5s", see FCMTTL.
+	TTL                   string                  `json:"ttl,omitempty"`
+	RestrictedPackageName string                  `json:"restricted_package_name,omitempty"`
+	Data                  map[string]string       `json:"data,omitempty"`
+	Notification          *FCMAndroidNotification `json:"notification,omitempty"`
+}
+
+// FCMAndroidNotification ...
+type FCMAndroidNotification struct {
+	Title       string `json:"title,omitempty"`
+	Body        string `json:"body,omitempty"`
+	Icon        string `json:"icon,omitempty"`
+	Color       string `json:"color,omitempty"`
+	Sound       string `json:"sound,omitempty"`
+	Tag         string `json:"tag,omitempty"`
+	ClickAction string `json:"click_action,omitempty"`
+	ChannelID   string `json:"channel_id,omitempty"`
+}
+
+// FCMAPNSConfig overrides the message for apple devices, the headers
+// and payload are the ones of the apns http/2 api.
+type FCMAPNSConfig struct {
+	Headers map[string]string      `json:"headers,omitempty"`
+	Payload map[string]interface{} `json:"payload,omitempty"`
+}
+
+// FCMWebpushConfig overrides the message for browsers.
+type FCMWebpushConfig struct {
+	Headers      map[string]string      `json:"headers,omitempty"`
+	Data         map[string]string      `json:"data,omitempty"`
+	Notification map[string]interface{} `json:"notification,omitempty"`
+	FCMOptions   *FCMWebpushOptions     `json:"fcm_options,omitempty"`
+}
+
+// FCMWebpushOptions ...
+type FCMWebpushOptions struct {
+	Link string `json:"link,omitempty"`
+}
+
+// FCMTTL formats seconds as an android ttl.
+func FCMTTL(seconds int) string {
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// Bytes implements interface Message.
+func (m *FCMMessage) Bytes() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// fcmRequest is the body of a send request.
+type fcmRequest struct {
+	ValidateOnly bool        `json:"validate_only,omitempty"`
+	Message      *FCMMessage `json:"message"`
+}
+
+// fcmError is the body of an error response.
+type fcmError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type      string `json:"@type"`
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// FCMResponse https://firebase.google.com/docs/reference/fcm/rest/v1/ErrorCode
+type FCMResponse struct {
+	StatusCode int `json:"statusCode"`
+	// Name is the id of the sent message,
+	// projects/<id>/messages/<message id>.
+	Name string `json:"name"`
+	// Status is the canonical error status, ErrorCode the fcm error
+	// code such as UNREGISTERED or QUOTA_EXCEEDED.
+	Status    string `json:"status,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+	Message   string `json:"message,omitempty"`
+	// set to -1 initially, if >= 0 then retry.
+	RetryAfter int   `json:"retryAfter"`
+	Error      error `json:"-"`
+}
+
+// Bytes implements interface Response.
+func (f *FCMResponse) Bytes() ([]byte, error) {
+	return json.Marshal(f)
+}
+
+// Retry implements interface Response.
+func (f *FCMResponse) Retry() int {
+	return f.RetryAfter
+}
+
+// UpdateToken implements interface Response.
+func (f *FCMResponse) UpdateToken() bool {
+	if f == nil {
+		return false
+	}
+	return isTokenError(f.Error)
+}
+
+// FCMClient sends with the HTTP v1 api, authenticating as a service
+// account.
+type FCMClient struct {
+	ProjectID string
+	Token     *FCMToken
+	// ValidateOnly checks the messages without delivering them.
+	ValidateOnly bool
+	// RetryPolicy sets the backoff when fcm gives no Retry-After,
+	// nil uses DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+	// Tokens removes the unregistered tokens if set.
+	Tokens TokenStore
+	http   *http.Client
+	url    string
+}
+
+// NewFCMClient returns a client for the project of the service account
+// key json. url is the api base url, see FCMURLs.
+func NewFCMClient(url string, account []byte) (*FCMClient, error) {
+	if url == "" {
+		return nil, fmt.Errorf("url not provided")
+	}
+	token, err := NewFCMToken(account)
+	if err != nil {
+		return nil, err
+	}
+	if token.Account.ProjectID == "" {
+		return nil, fmt.Errorf("project_id not provided")
+	}
+	return &FCMClient{
+		ProjectID: token.Account.ProjectID,
+		Token:     token,
+		http:      &http.Client{Timeout: 20 * time.Second},
+		url:       strings.TrimSuffix(url, "/"),
+	}, nil
+}
+
+// Send sends the message. An expired or revoked access token is
+// replaced and the message sent once more.
+func (c *FCMClient) Send(m *FCMMessage) (*FCMResponse, error) {
+	ret, err := c.send(m)
+	if err == ErrTokenExpired {
+		ret, err = c.send(m)
+	}
+	if err == ErrRemoveToken && m.Token != "" {
+		serr := storeTokens(c.Tokens, PlatformFCM, tokenChange{old: m.Token})
+		if serr != nil {
+			ret.Error = serr
+			err = serr
+		}
+	}
+	return ret, err
+}
+
+// send makes a single request.
+func (c *FCMClient) send(m *FCMMessage) (*FCMResponse, error) {
+	if m.Token == "" && m.Topic == "" && m.Condition == "" {
+		return nil, fmt.Errorf("no token, topic or condition")
+	}
+	j, err := json.Marshal(&fcmRequest{ValidateOnly: c.ValidateOnly, Message: m})
+	if err != nil {
+		return nil, err
+	}
+	access, err := c.Token.AccessToken()
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("POST", c.url+fmt.Sprintf(FCMPath, c.ProjectID), bytes.NewBuffer(j))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+access)
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &FCMResponse{StatusCode: resp.StatusCode, RetryAfter: -1}
+	if resp.StatusCode == 200 {
+		err = json.Unmarshal(body, ret)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+
+	e := fcmError{}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &e)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected response %s %s", resp.Status, string(body))
+		}
+	}
+	ret.Status = e.Error.Status
+	ret.Message = e.Error.Message
+	for _, d := range e.Error.Details {
+		if strings.HasSuffix(d.Type, "google.firebase.fcm.v1.FcmError") {
+			ret.ErrorCode = d.ErrorCode
+		}
+	}
+
+	switch {
+	case ret.ErrorCode == "UNREGISTERED":
+		// The app was uninstalled or the token expired.
+		ret.Error = ErrRemoveToken
+	case resp.StatusCode == 401:
+		// The access token expired or was revoked.
+		c.Token.expire()
+		ret.RetryAfter = 0
+		ret.Error = ErrTokenExpired
+	case resp.StatusCode == 429, resp.StatusCode >= 500:
+		// QUOTA_EXCEEDED, UNAVAILABLE, INTERNAL.
+		ret.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
+		ret.Error = ErrRetry
+	default:
+		// INVALID_ARGUMENT, SENDER_ID_MISMATCH, THIRD_PARTY_AUTH_ERROR.
+		code := ret.ErrorCode
+		if code == "" {
+			code = ret.Status
+		}
+		ret.Error = fmt.Errorf("fcm %d %s %s", resp.StatusCode, code, ret.Message)
+	}
+	return ret, ret.Error
+}
@@ -0,0 +1,281 @@
+package hermes
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fcmFakeServer hands out access tokens for service account assertions
+// and accepts sends with them. Tokens are answered by prefix: "gone"
+// is unregistered, "busy" unavailable and "bad" an invalid argument.
+type fcmFakeServer struct {
+	*httptest.Server
+	pub *rsa.PublicKey
+
+	mu       sync.Mutex
+	issued   int
+	valid    map[string]bool
+	messages []*FCMMessage
+}
+
+var (
+	FCMServer *fcmFakeServer
+	// FCMAccount is a service account using FCMServer's token endpoint.
+	FCMAccount []byte
+)
+
+func init() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	FCMServer = &fcmFakeServer{pub: &key.PublicKey, valid: make(map[string]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", FCMServer.token)
+	mux.HandleFunc("/v1/projects/test-project/messages:send", FCMServer.send)
+	FCMServer.Server = httptest.NewServer(mux)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	FCMAccount, _ = json.Marshal(&FCMServiceAccount{
+		Type:         "service_account",
+		ProjectID:    "test-project",
+		PrivateKeyID: "abc123",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:  "hermes@test-project.iam.gserviceaccount.com",
+		TokenURI:     FCMServer.URL + "/token",
+	})
+}
+
+// reset forgets the tokens issued and messages received.
+func (s *fcmFakeServer) reset() {
+	s.mu.Lock()
+	s.issued = 0
+	s.valid = make(map[string]bool)
+	s.messages = nil
+	s.mu.Unlock()
+}
+
+func (s *fcmFakeServer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, `{"error":"unsupported_grant_type"}`)
+		return
+	}
+	parts := strings.Split(r.Form.Get("assertion"), ".")
+	if len(parts) != 3 {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, `{"error":"invalid_grant"}`)
+		return
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(s.pub, crypto.SHA256, digest[:], sig) != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, `{"error":"invalid_grant","error_description":"Invalid JWT Signature."}`)
+		return
+	}
+	claims := map[string]interface{}{}
+	c, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(c, &claims)
+	if claims["scope"] != FCMScope || claims["aud"] != s.URL+"/token" || claims["iss"] != "hermes@test-project.iam.gserviceaccount.com" {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, `{"error":"invalid_grant","error_description":"Invalid JWT claims."}`)
+		return
+	}
+
+	s.mu.Lock()
+	s.issued++
+	access := fmt.Sprintf("access-%d", s.issued)
+	s.valid[access] = true
+	s.mu.Unlock()
+	fmt.Fprintf(w, `{"access_token":%q,"expires_in":3600,"token_type":"Bearer"}`, access)
+}
+
+// revoke invalidates every access token issued so far.
+func (s *fcmFakeServer) revoke() {
+	s.mu.Lock()
+	s.valid = make(map[string]bool)
+	s.mu.Unlock()
+}
+
+func (s *fcmFakeServer) send(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	valid := s.valid[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	s.mu.Unlock()
+	if !valid {
+		w.WriteHeader(401)
+		fmt.Fprintln(w, `{"error":{"code":401,"message":"Request had invalid authentication credentials.","status":"UNAUTHENTICATED"}}`)
+		return
+	}
+	req := fcmRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Message == nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, `{"error":{"code":400,"message":"Invalid JSON payload","status":"INVALID_ARGUMENT"}}`)
+		return
+	}
+	s.mu.Lock()
+	s.messages = append(s.messages, req.Message)
+	s.mu.Unlock()
+
+	fcmError := func(code int, status, errorCode string) {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error":{"code":%d,"message":"failed","status":%q,"details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":%q}]}}`, code, status, errorCode)
+	}
+	switch token := req.Message.Token; {
+	case strings.HasPrefix(token, "gone"):
+		fcmError(404, "NOT_FOUND", "UNREGISTERED")
+	case strings.HasPrefix(token, "busy"):
+		w.Header().Set("Retry-After", "7")
+		fcmError(503, "UNAVAILABLE", "UNAVAILABLE")
+	case strings.HasPrefix(token, "bad"):
+		fcmError(400, "INVALID_ARGUMENT", "INVALID_ARGUMENT")
+	default:
+		fmt.Fprintln(w, `{"name":"projects/test-project/messages/0:1500415314455276%31bd1c9631bd1c96"}`)
+	}
+}
+
+func TestNewFCMClient(t *testing.T) {
+	a := FCMServiceAccount{}
+	json.Unmarshal(FCMAccount, &a)
+	a.TokenURI = ""
+	account, _ := json.Marshal(&a)
+	c, err := NewFCMClient(FCMURLs["testing"], account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ProjectID != "test-project" || c.Token.Account.TokenURI != FCMTokenURI {
+		t.Fatalf("client not initialized %+v", c.Token.Account)
+	}
+	if _, err = NewFCMClient("", account); err == nil {
+		t.Fatal("expected error without url")
+	}
+	if _, err = NewFCMClient(FCMURLs["testing"], []byte(`{"client_email":"a"}`)); err == nil {
+		t.Fatal("expected error without private key")
+	}
+}
+
+func TestFCMSend(t *testing.T) {
+	FCMServer.reset()
+	c, err := NewFCMClient(FCMServer.URL, FCMAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &FCMMessage{
+		Token:        "abc",
+		Notification: &FCMNotification{Title: "hello", Body: "world"},
+		Data:         map[string]string{"a": "b"},
+		Android:      &FCMAndroidConfig{Priority: "high", TTL: FCMTTL(60)},
+		APNS:         &FCMAPNSConfig{Headers: map[string]string{"apns-priority": "10"}},
+		Webpush:      &FCMWebpushConfig{FCMOptions: &FCMWebpushOptions{Link: "https://example.com"}},
+	}
+	resp, err := c.Send(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.Name, "projects/test-project/messages/") || resp.Retry() != -1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	got := FCMServer.messages[0]
+	if got.Android.TTL != "60s" || got.Notification.Title != "hello" || got.Webpush.FCMOptions.Link != "https://example.com" {
+		t.Fatalf("message not sent as is %+v", got)
+	}
+
+	// The access token is cached.
+	c.Send(m)
+	if FCMServer.issued != 1 {
+		t.Fatalf("expected 1 access token got %d", FCMServer.issued)
+	}
+
+	// A revoked token is replaced and the message sent again.
+	FCMServer.revoke()
+	_, err = c.Send(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if FCMServer.issued != 2 {
+		t.Fatalf("expected a new access token got %d", FCMServer.issued)
+	}
+
+	if _, err = c.Send(&FCMMessage{}); err == nil {
+		t.Fatal("expected error without a target")
+	}
+}
+
+func TestFCMSendErrors(t *testing.T) {
+	FCMServer.reset()
+	c, err := NewFCMClient(FCMServer.URL, FCMAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMemoryTokenStore()
+	s.Add(PlatformFCM, "gone1")
+	c.Tokens = s
+
+	resp, err := c.Send(&FCMMessage{Token: "gone1"})
+	if err != ErrRemoveToken || !resp.UpdateToken() || resp.ErrorCode != "UNREGISTERED" {
+		t.Fatalf("expected remove token got %v %+v", err, resp)
+	}
+	if _, ok, _ := s.Lookup(PlatformFCM, "gone1"); ok {
+		t.Fatal("expected token removed")
+	}
+
+	resp, err = c.Send(&FCMMessage{Token: "busy"})
+	if err != ErrRetry || resp.Retry() != 7 {
+		t.Fatalf("expected retry after 7 got %v %+v", err, resp)
+	}
+
+	resp, err = c.Send(&FCMMessage{Token: "bad"})
+	if err == nil || err == ErrRetry || resp.Retry() != -1 || resp.Status != "INVALID_ARGUMENT" {
+		t.Fatalf("expected invalid argument got %v %+v", err, resp)
+	}
+}
+
+func TestFCMService(t *testing.T) {
+	FCMServer.reset()
+	c, err := NewFCMClient(FCMServer.URL, FCMAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter()
+	r.AddApp("app", &RouterApp{FCM: c})
+	n := &Notification{Title: "hello", Badge: 1, CollapseKey: "updates", Priority: PriorityHigh, TTL: 60, Data: map[string]interface{}{"a": "b"}}
+	results := r.Send("app", &Target{PlatformFCM, "abc", n}, &Target{PlatformFCM, "gone", n})
+	if results[0].Error != nil {
+		t.Fatal(results[0].Error)
+	}
+	if len(results.UpdateToken()) != 1 {
+		t.Fatalf("expected a token update got %+v", results.UpdateToken())
+	}
+	var got *FCMMessage
+	for _, m := range FCMServer.messages {
+		if m.Token == "abc" {
+			got = m
+		}
+	}
+	if got == nil || got.Data["a"] != "b" || got.Android.Priority != "high" || got.Android.CollapseKey != "updates" {
+		t.Fatalf("unexpected message %+v", got)
+	}
+	if got.APNS.Headers["apns-priority"] != "10" || got.APNS.Headers["apns-collapse-id"] != "updates" {
+		t.Fatalf("unexpected apns block %+v", got.APNS)
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-// GCMURLs map environment to gcm url.
+// GCMURLs map environment to gcm url. The legacy gcm api was shut
+// down, FCMClient sends with its replacement.
 var GCMURLs = map[string]string{
 	"testing":     "http://localhost:5556",
 	"development": "https://android.googleapis.com/gcm/send",
@@ -21,14 +23,58 @@ var GCMURLs = map[string]string{
 }
 
 // GCMMessage http://developer.android.com/guide/google/gcm/gcm.html#send-msg
+// One of RegistrationIDs, To, Condition or NotificationKey is the target.
 type GCMMessage struct {
-	RegistrationIDs []string `json:"registration_ids"`
-	//NotificationKey string                 `json:"notification_key"`
-	CollapseKey    string                 `json:"collapse_key,omitempty"`
-	Data           map[string]interface{} `json:"data,omitempty"`
-	DelayWhileIdle bool                   `json:"delay_while_idle,omitempty"`
-	TimeToLive     int                    `json:"time_to_live,omitempty"`
-	DryRun         bool                   `json:"dry_run,omitempty"`
+	RegistrationIDs []string `json:"registration_ids,omitempty"`
+	// To is a topic, see GCMTopic.
+	To string `json:"to,omitempty"`
+	// Condition is an expression of topics, see GCMCondition.
+	Condition string `json:"condition,omitempty"`
+	// NotificationKey is a device group, see GCMClient.CreateGroup.
+	NotificationKey string                 `json:"notification_key,omitempty"`
+	CollapseKey     string                 `json:"collapse_key,omitempty"`
+	Data            map[string]interface{} `json:"data,omitempty"`
+	Notification    *GCMNotification       `json:"notification,omitempty"`
+	DelayWhileIdle  bool                   `json:"delay_while_idle,omitempty"`
+	TimeToLive      int                    `json:"time_to_live,omitempty"`
+	DryRun          bool                   `json:"dry_run,omitempty"`
+	// Priority is GCMPriorityNormal or GCMPriorityHigh.
+	Priority string `json:"priority,omitempty"`
+	// ContentAvailable wakes an inactive ios app, MutableContent lets
+	// its notification service extension change the notification.
+	ContentAvailable      bool   `json:"content_available,omitempty"`
+	MutableContent        bool   `json:"mutable_content,omitempty"`
+	RestrictedPackageName string `json:"restricted_package_name,omitempty"`
+}
+
+// GCMNotification is displayed by the device instead of being passed
+// to the app as data.
+type GCMNotification struct {
+	Title        string   `json:"title,omitempty"`
+	Body         string   `json:"body,omitempty"`
+	Icon         string   `json:"icon,omitempty"`
+	Sound        string   `json:"sound,omitempty"`
+	Tag          string   `json:"tag,omitempty"`
+	Color        string   `json:"color,omitempty"`
+	ClickAction  string   `json:"click_action,omitempty"`
+	BodyLocKey   string   `json:"body_loc_key,omitempty"`
+	BodyLocArgs  []string `json:"body_loc_args,omitempty"`
+	TitleLocKey  string   `json:"title_loc_key,omitempty"`
+	TitleLocArgs []string `json:"title_loc_args,omitempty"`
+}
+
+// Priorities of GCMMessage.
+const (
+	GCMPriorityNormal = "normal"
+	GCMPriorityHigh   = "high"
+)
+
+// gcmReservedKeys can't be used as data keys, nor can keys starting
+// with "google" or "gcm".
+var gcmReservedKeys = map[string]bool{
+	"from":         true,
+	"notification": true,
+	"message_type": true,
 }
 
 // Bytes implements interface Message.
@@ -36,6 +82,42 @@ func (g *GCMMessage) Bytes() ([]byte, error) {
 	return json.Marshal(g)
 }
 
+// Validate checks the target, data keys, priority and time to live.
+func (g *GCMMessage) Validate() error {
+	targets := 0
+	for _, set := range []bool{len(g.RegistrationIDs) > 0, g.To != "", g.Condition != "", g.NotificationKey != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return fmt.Errorf("only one of registration ids, to, condition and notification key can be set")
+	}
+	if strings.HasPrefix(g.To, gcmTopicPrefix) && !gcmTopicName.MatchString(strings.TrimPrefix(g.To, gcmTopicPrefix)) {
+		return fmt.Errorf("invalid topic %q", g.To)
+	}
+	if g.Condition != "" {
+		err := ValidateGCMCondition(g.Condition)
+		if err != nil {
+			return err
+		}
+	}
+	for k := range g.Data {
+		if gcmReservedKeys[k] || strings.HasPrefix(k, "google") || strings.HasPrefix(k, "gcm") {
+			return fmt.Errorf("data key %q is reserved", k)
+		}
+	}
+	switch g.Priority {
+	case "", GCMPriorityNormal, GCMPriorityHigh:
+	default:
+		return fmt.Errorf("unknown priority %q", g.Priority)
+	}
+	if g.TimeToLive < 0 || g.TimeToLive > gcmMaxTTL {
+		return fmt.Errorf("time to live must be between 0 and %d seconds", gcmMaxTTL)
+	}
+	return nil
+}
+
 // GCMResult embedded response from gcm.
 type GCMResult struct {
 	MessageID      string `json:"message_id"`
@@ -43,6 +125,84 @@ type GCMResult struct {
 	Error          string `json:"error"`
 }
 
+// GCMOutcome is what happened to one recipient of a message.
+type GCMOutcome int
+
+// Outcomes of GCMResult.
+const (
+	GCMSuccess GCMOutcome = iota
+	// GCMCanonical was sent, the registration id has to be replaced
+	// with the result's RegistrationID.
+	GCMCanonical
+	GCMNotRegistered
+	GCMInvalidRegistration
+	GCMMismatchSenderID
+	GCMMessageTooBig
+	GCMUnavailable
+	GCMInternalServerError
+	GCMDeviceMessageRateExceeded
+	GCMTopicsMessageRateExceeded
+	// GCMOtherError is any other error, see the result's Error.
+	GCMOtherError
+)
+
+var gcmOutcomes = map[string]GCMOutcome{
+	"NotRegistered":             GCMNotRegistered,
+	"InvalidRegistration":       GCMInvalidRegistration,
+	"MismatchSenderId":          GCMMismatchSenderID,
+	"MessageTooBig":             GCMMessageTooBig,
+	"Unavailable":               GCMUnavailable,
+	"InternalServerError":       GCMInternalServerError,
+	"DeviceMessageRateExceeded": GCMDeviceMessageRateExceeded,
+	"TopicsMessageRateExceeded": GCMTopicsMessageRateExceeded,
+}
+
+func (o GCMOutcome) String() string {
+	switch o {
+	case GCMSuccess:
+		return "Success"
+	case GCMCanonical:
+		return "Canonical"
+	case GCMOtherError:
+		return "OtherError"
+	}
+	for name, outcome := range gcmOutcomes {
+		if outcome == o {
+			return name
+		}
+	}
+	return fmt.Sprintf("GCMOutcome(%d)", int(o))
+}
+
+// Remove reports whether the registration id should be removed.
+func (o GCMOutcome) Remove() bool {
+	return o == GCMNotRegistered || o == GCMInvalidRegistration
+}
+
+// Retry reports whether sending again later may succeed.
+func (o GCMOutcome) Retry() bool {
+	switch o {
+	case GCMUnavailable, GCMInternalServerError, GCMDeviceMessageRateExceeded, GCMTopicsMessageRateExceeded:
+		return true
+	}
+	return false
+}
+
+// Outcome classifies the result.
+func (r *GCMResult) Outcome() GCMOutcome {
+	if r.Error == "" {
+		if r.RegistrationID != "" {
+			return GCMCanonical
+		}
+		return GCMSuccess
+	}
+	o, ok := gcmOutcomes[r.Error]
+	if !ok {
+		return GCMOtherError
+	}
+	return o
+}
+
 // GCMResponse http://developer.android.com/guide/google/gcm/gcm.html#send-msg
 type GCMResponse struct {
 	MulticastID  int64        `json:"multicast_id"`
@@ -50,7 +210,16 @@ type GCMResponse struct {
 	Failure      int          `json:"failure"`
 	CanonicalIDs int          `json:"canonical_ids"`
 	Results      []*GCMResult `json:"results"`
-	StatusCode   int          `json:"status_code"`
+	// MessageID is set for messages to a topic or condition, which
+	// have a single result.
+	MessageID string `json:"message_id,omitempty"`
+	// FailedRegistrationIDs are the members of a device group the
+	// message could not be sent to.
+	FailedRegistrationIDs []string `json:"failed_registration_ids,omitempty"`
+	// RegistrationIDs are the ids of Results, set when there is a
+	// result for each registration id of the message.
+	RegistrationIDs []string `json:"-"`
+	StatusCode      int      `json:"status_code"`
 	// set to -1 initially, if >= 0 then retry.
 	RetryAfter   int   `json:"retry_after"`
 	Error        error `json:"error"`
@@ -67,22 +236,43 @@ func (g *GCMResponse) Retry() int {
 	return g.RetryAfter
 }
 
-// UpdateToken implements interface Response.
+// UpdateToken implements interface Response, true if any registration
+// id has to be removed or replaced.
 func (g *GCMResponse) UpdateToken() bool {
 	if g == nil {
 		return false
 	}
-	if g.Error == ErrRemoveToken || g.Error == ErrUpdateToken {
+	if isTokenError(g.Error) {
 		return true
 	}
+	for _, result := range g.Results {
+		if o := result.Outcome(); o == GCMCanonical || o.Remove() {
+			return true
+		}
+	}
 	return false
 }
 
 // GCMClient ...
 type GCMClient struct {
-	key  string
-	http *http.Client
-	url  string
+	// RetryPolicy sets the backoff when the service gives no
+	// Retry-After, nil uses DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+	// ResendPolicy resends the recipients that were Unavailable within
+	// Send, which blocks until they succeed or it gives up. Nil leaves
+	// them to the caller with ErrRetry. Keep it nil when sending
+	// through a queue, which retries the whole send with its own policy.
+	ResendPolicy *RetryPolicy
+	// Tokens is updated with the canonical and unregistered ids of
+	// each send if set.
+	Tokens TokenStore
+	// SenderID is the project number, required to manage device
+	// groups at GroupURL.
+	SenderID string
+	GroupURL string
+	key      string
+	http     *http.Client
+	url      string
 }
 
 // NewGCMClient ...
@@ -112,9 +302,10 @@ func NewGCMClient(apiURL, key, proxy string) (*GCMClient, error) {
 	}
 
 	return &GCMClient{
-		key:  key,
-		http: &http.Client{Transport: tr},
-		url:  apiURL,
+		GroupURL: strings.TrimSuffix(apiURL, "/send") + "/notification",
+		key:      key,
+		http:     &http.Client{Transport: tr},
+		url:      apiURL,
 	}, nil
 }
 
@@ -141,11 +332,252 @@ func (g *GCMMessage) SetPayload(key string, value string) {
 	g.Data[key] = value
 }
 
-// Send ...
+// GCMMaxRecipients is the most registration ids gcm takes in a request.
+const GCMMaxRecipients = 1000
+
+// Send sends the message in concurrent batches of GCMMaxRecipients,
+// merging the results in the order of RegistrationIDs. A batch that
+// fails without a response gives each of its recipients an error
+// result, Unavailable if it failed in transport. With a ResendPolicy
+// recipients whose result is Unavailable or InternalServerError, and
+// those of a request the service asked to retry, are sent again on
+// their own, waiting as it says but at least the Retry-After until they
+// succeed or it gives up.
+//
+// Error is ErrRetry if any recipient can be retried, otherwise
+// ErrRemoveToken or ErrUpdateToken if any registration id has to be
+// removed or replaced, otherwise the first error of the results. See
+// RemoveIDs, ReplaceIDs and RetryIDs for the ids of each.
 func (c *GCMClient) Send(m *GCMMessage) (*GCMResponse, error) {
-	ret := GCMResponse{RetryAfter: -1}
+	err := m.Validate()
+	if err != nil {
+		return nil, err
+	}
 	start := time.Now()
-	defer func() { ret.ResponseTime = time.Since(start).Nanoseconds() / 1000000 }()
+	ret, retry, err := c.sendBatches(m, nil)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; c.ResendPolicy != nil && len(retry) > 0; attempt++ {
+		delay, ok := c.ResendPolicy.Next(attempt, start, time.Duration(ret.RetryAfter)*time.Second)
+		if !ok {
+			break
+		}
+		time.Sleep(delay)
+		again, next, err := c.sendBatches(m, retry)
+		if err != nil {
+			break
+		}
+		for i, index := range retry {
+			ret.Results[index] = again.Results[i]
+		}
+		ret.StatusCode = again.StatusCode
+		ret.RetryAfter = again.RetryAfter
+		ret.Error = again.Error
+		retry = next
+	}
+	if ret.Error == nil && len(ret.FailedRegistrationIDs) > 0 && c.ResendPolicy != nil {
+		if delay, ok := c.ResendPolicy.Next(1, start, 0); ok {
+			time.Sleep(delay)
+			return c.resendGroup(m, ret, start)
+		}
+	}
+	ret.count()
+	ret.ResponseTime = time.Since(start).Nanoseconds() / 1000000
+
+	if ret.Results == nil {
+		if ret.Error == nil && ret.Failure > 0 {
+			// A device group none of the members got.
+			ret.RetryAfter = c.RetryPolicy.RetryAfter(nil)
+			ret.Error = ErrRetry
+		}
+		return ret, ret.Error
+	}
+
+	if len(ret.Results) == len(m.RegistrationIDs) {
+		ret.RegistrationIDs = m.RegistrationIDs
+	}
+	if ret.Error == nil {
+		ret.Error = ret.resultsError()
+		if ret.Error == ErrRetry {
+			ret.RetryAfter = c.RetryPolicy.RetryAfter(nil)
+		}
+	}
+
+	err = storeTokens(c.Tokens, PlatformGCM, gcmTokenChanges(ret)...)
+	if err != nil {
+		ret.Error = err
+	}
+	return ret, ret.Error
+}
+
+// resendGroup sends m to the members of the device group that failed
+// in ret by their registration ids. The results of that send are set in
+// ret, the members it failed for again stay in FailedRegistrationIDs.
+// Success adds the members reached to those the group send reached,
+// Failure and CanonicalIDs are those of the results.
+func (c *GCMClient) resendGroup(m *GCMMessage, ret *GCMResponse, start time.Time) (*GCMResponse, error) {
+	members := *m
+	members.NotificationKey = ""
+	members.To = ""
+	members.RegistrationIDs = ret.FailedRegistrationIDs
+	resp, err := c.Send(&members)
+	ret.ResponseTime = time.Since(start).Nanoseconds() / 1000000
+	if resp == nil {
+		ret.Error = err
+		return ret, ret.Error
+	}
+	ret.StatusCode = resp.StatusCode
+	ret.RetryAfter = resp.RetryAfter
+	ret.Error = resp.Error
+	if resp.RegistrationIDs == nil {
+		return ret, ret.Error
+	}
+	failed := []string{}
+	for i, id := range resp.RegistrationIDs {
+		switch resp.Results[i].Outcome() {
+		case GCMSuccess, GCMCanonical:
+		default:
+			failed = append(failed, id)
+		}
+	}
+	ret.Success += resp.Success
+	ret.Failure = resp.Failure
+	ret.FailedRegistrationIDs = failed
+	ret.Results = resp.Results
+	ret.RegistrationIDs = resp.RegistrationIDs
+	ret.CanonicalIDs = resp.CanonicalIDs
+	return ret, ret.Error
+}
+
+// sendBatches sends m to the registration ids at indexes, all of them
+// if nil, in batches of GCMMaxRecipients. The results are in the order
+// of indexes. A batch the service asked to retry gets Unavailable
+// results and sets the response's RetryAfter and Error, one without a
+// response gets gcmBatchError results. It returns the indexes of the
+// recipients to resend.
+func (c *GCMClient) sendBatches(m *GCMMessage, indexes []int) (*GCMResponse, []int, error) {
+	if indexes == nil && len(m.RegistrationIDs) <= GCMMaxRecipients {
+		// Sent as is, the results may not match the ids for other
+		// recipients than registration ids.
+		ret, err := c.send(m)
+		if ret == nil {
+			return nil, nil, err
+		}
+		retry := []int{}
+		if ret.Error != nil && len(m.RegistrationIDs) > 0 {
+			ret.Results = make([]*GCMResult, len(m.RegistrationIDs))
+			for i := range ret.Results {
+				ret.Results[i] = &GCMResult{Error: "Unavailable"}
+				retry = append(retry, i)
+			}
+		}
+		if ret.Error == nil && len(ret.Results) == len(m.RegistrationIDs) {
+			for i, result := range ret.Results {
+				if o := result.Outcome(); o == GCMUnavailable || o == GCMInternalServerError {
+					retry = append(retry, i)
+				}
+			}
+		}
+		return ret, retry, nil
+	}
+
+	if indexes == nil {
+		indexes = make([]int, len(m.RegistrationIDs))
+		for i := range indexes {
+			indexes[i] = i
+		}
+	}
+	type batch struct {
+		offset int
+		resp   *GCMResponse
+		err    error
+	}
+	batches := make([]*batch, 0, len(indexes)/GCMMaxRecipients+1)
+	wg := sync.WaitGroup{}
+	for offset := 0; offset < len(indexes); offset += GCMMaxRecipients {
+		end := offset + GCMMaxRecipients
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+		bm := *m
+		bm.RegistrationIDs = make([]string, 0, end-offset)
+		for _, index := range indexes[offset:end] {
+			bm.RegistrationIDs = append(bm.RegistrationIDs, m.RegistrationIDs[index])
+		}
+		b := &batch{offset: offset}
+		batches = append(batches, b)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.resp, b.err = c.send(&bm)
+		}()
+	}
+	wg.Wait()
+
+	ret := &GCMResponse{
+		StatusCode: 200,
+		RetryAfter: -1,
+		Results:    make([]*GCMResult, len(indexes)),
+	}
+	retry := []int{}
+	for _, b := range batches {
+		n := GCMMaxRecipients
+		if b.offset+n > len(indexes) {
+			n = len(indexes) - b.offset
+		}
+		if b.resp != nil && b.resp.Error == nil && len(b.resp.Results) != n {
+			b.resp, b.err = nil, fmt.Errorf("expected %d results got %d", n, len(b.resp.Results))
+		}
+		if b.resp == nil {
+			// The other batches were delivered, keep their results.
+			for i := 0; i < n; i++ {
+				result := gcmBatchError(b.err)
+				ret.Results[b.offset+i] = result
+				if result.Outcome() == GCMUnavailable {
+					retry = append(retry, indexes[b.offset+i])
+				}
+			}
+			continue
+		}
+		if b.resp.Error != nil {
+			ret.StatusCode = b.resp.StatusCode
+			if b.resp.RetryAfter > ret.RetryAfter {
+				ret.RetryAfter = b.resp.RetryAfter
+			}
+			ret.Error = b.resp.Error
+			for i := 0; i < n; i++ {
+				ret.Results[b.offset+i] = &GCMResult{Error: "Unavailable"}
+				retry = append(retry, indexes[b.offset+i])
+			}
+			continue
+		}
+		if ret.MulticastID == 0 {
+			ret.MulticastID = b.resp.MulticastID
+		}
+		for i, result := range b.resp.Results {
+			ret.Results[b.offset+i] = result
+			if o := result.Outcome(); o == GCMUnavailable || o == GCMInternalServerError {
+				retry = append(retry, indexes[b.offset+i])
+			}
+		}
+	}
+	return ret, retry, nil
+}
+
+// gcmBatchError is the result of each recipient of a batch that failed
+// with err instead of a response. A transport error is Unavailable,
+// anything else, like a 400 or 401, fails the same way again.
+func gcmBatchError(err error) *GCMResult {
+	if _, ok := err.(net.Error); ok {
+		return &GCMResult{Error: "Unavailable"}
+	}
+	return &GCMResult{Error: err.Error()}
+}
+
+// send makes a single request.
+func (c *GCMClient) send(m *GCMMessage) (*GCMResponse, error) {
+	ret := GCMResponse{RetryAfter: -1}
 	j, err := json.Marshal(m)
 	if err != nil {
 		return nil, err
@@ -168,6 +600,7 @@ func (c *GCMClient) Send(m *GCMMessage) (*GCMResponse, error) {
 		return nil, err
 	}
 
+	ret.StatusCode = resp.StatusCode
 	switch {
 	case resp.StatusCode >= 500 && resp.StatusCode <= 599:
 		// Errors in the 500-599 range (such as 500 or 503) indicate that
@@ -176,9 +609,7 @@ func (c *GCMClient) Send(m *GCMMessage) (*GCMResponse, error) {
 		// server is temporarily unavailable
 		// (for example, because of timeouts). Sender must retry later,
 		// honoring any Retry-After header included in the response.
-		after := resp.Header.Get("Retry-After")
-		sleepFor, _ := strconv.Atoi(after)
-		ret.RetryAfter = sleepFor
+		ret.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
 		ret.Error = ErrRetry
 	case resp.StatusCode == 401:
 		return nil, fmt.Errorf("unauthorized %s %s", resp.Status, string(body))
@@ -190,30 +621,143 @@ func (c *GCMClient) Send(m *GCMMessage) (*GCMResponse, error) {
 		// should be addressed before the request can be retried.
 		return nil, fmt.Errorf("malformed JSON %s %s", resp.Status, string(body))
 	case resp.StatusCode == 200:
-		err = json.Unmarshal(body, &ret)
+		err = ret.parse(body)
 		if err != nil {
 			return nil, err
 		}
 	default:
-		after := resp.Header.Get("Retry-After")
-		sleepFor, _ := strconv.Atoi(after)
-		ret.RetryAfter = sleepFor
+		ret.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
 		ret.Error = ErrRetry
-		return &ret, ret.Error
 	}
+	return &ret, ret.Error
+}
 
-	refresh := ret.RefreshIndexes()
-	if len(refresh) > 0 {
-		ret.Error = ErrUpdateToken
+// gcmResponseBody is a response as sent by gcm, the error of a topic
+// response would not unmarshal into GCMResponse.Error.
+type gcmResponseBody struct {
+	MulticastID  int64           `json:"multicast_id"`
+	Success      int             `json:"success"`
+	Failure      int             `json:"failure"`
+	CanonicalIDs int             `json:"canonical_ids"`
+	Results      []*GCMResult    `json:"results"`
+	MessageID    json.RawMessage `json:"message_id"`
+	Error        string          `json:"error"`
+	// FailedRegistrationIDs of a device group response.
+	FailedRegistrationIDs []string `json:"failed_registration_ids"`
+}
+
+// parse reads the body of a 200 response, a topic response is turned
+// into a single result.
+func (g *GCMResponse) parse(body []byte) error {
+	b := gcmResponseBody{}
+	err := json.Unmarshal(body, &b)
+	if err != nil {
+		return err
 	}
+	g.MulticastID = b.MulticastID
+	g.Success = b.Success
+	g.Failure = b.Failure
+	g.CanonicalIDs = b.CanonicalIDs
+	g.Results = b.Results
+	g.FailedRegistrationIDs = b.FailedRegistrationIDs
+	if len(b.MessageID) > 0 || b.Error != "" {
+		// A number, but keep it as is if it's a string.
+		g.MessageID = strings.Trim(string(b.MessageID), `"`)
+		g.Results = []*GCMResult{{MessageID: g.MessageID, Error: b.Error}}
+	}
+	return nil
+}
 
-	errs := ret.ErrorIndexes()
-	if len(errs) > 0 {
-		ret.Error = ErrRemoveToken
+// count sets the totals from the results.
+func (g *GCMResponse) count() {
+	if g.Results == nil {
+		return
+	}
+	g.Success, g.Failure, g.CanonicalIDs = 0, 0, 0
+	for _, result := range g.Results {
+		if result.Error == "" {
+			g.Success++
+		} else {
+			g.Failure++
+		}
+		if result.RegistrationID != "" {
+			g.CanonicalIDs++
+		}
 	}
+}
 
-	ret.StatusCode = resp.StatusCode
-	return &ret, ret.Error
+// gcmTokenChanges returns the canonical ids to replace and the ids no
+// longer registered.
+func gcmTokenChanges(g *GCMResponse) []tokenChange {
+	ret := []tokenChange{}
+	for i, id := range g.RegistrationIDs {
+		result := g.Results[i]
+		switch o := result.Outcome(); {
+		case o.Remove():
+			ret = append(ret, tokenChange{old: id})
+		case o == GCMCanonical:
+			ret = append(ret, tokenChange{old: id, new: result.RegistrationID})
+		}
+	}
+	return ret
+}
+
+// resultsError returns the error of the response for its results.
+func (g *GCMResponse) resultsError() error {
+	var remove, replace bool
+	var err error
+	for _, result := range g.Results {
+		switch o := result.Outcome(); {
+		case o.Retry():
+			return ErrRetry
+		case o.Remove():
+			remove = true
+		case o == GCMCanonical:
+			replace = true
+		case o != GCMSuccess && err == nil:
+			err = fmt.Errorf("gcm %s", result.Error)
+		}
+	}
+	switch {
+	case remove:
+		return ErrRemoveToken
+	case replace:
+		return ErrUpdateToken
+	}
+	return err
+}
+
+// RemoveIDs returns the registration ids that are no longer valid.
+func (g *GCMResponse) RemoveIDs() []string {
+	ret := []string{}
+	for i, id := range g.RegistrationIDs {
+		if g.Results[i].Outcome().Remove() {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// ReplaceIDs maps the registration ids to replace to their canonical id.
+func (g *GCMResponse) ReplaceIDs() map[string]string {
+	ret := map[string]string{}
+	for i, id := range g.RegistrationIDs {
+		if g.Results[i].Outcome() == GCMCanonical {
+			ret[id] = g.Results[i].RegistrationID
+		}
+	}
+	return ret
+}
+
+// RetryIDs returns the registration ids to send to again later.
+func (g *GCMResponse) RetryIDs() []string {
+	ret := []string{}
+	for i, id := range g.RegistrationIDs {
+		if g.Results[i].Outcome().Retry() {
+			ret = append(ret, id)
+		}
+	}
+	return ret
 }
 
 // SuccessIndexes return the indexes of successfully sent registration ids.
@@ -0,0 +1,94 @@
+package hermes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// GCMMaxGroupMembers is the most registration ids a device group has.
+const GCMMaxGroupMembers = 20
+
+// gcmGroupOperation is a request to the device group url.
+type gcmGroupOperation struct {
+	Operation       string   `json:"operation"`
+	Name            string   `json:"notification_key_name"`
+	Key             string   `json:"notification_key,omitempty"`
+	RegistrationIDs []string `json:"registration_ids"`
+}
+
+// gcmGroupResponse is the response to a gcmGroupOperation.
+type gcmGroupResponse struct {
+	Key   string `json:"notification_key"`
+	Error string `json:"error"`
+}
+
+// CreateGroup creates the device group name of the registration ids and
+// returns its notification key to send to with GCMMessage.NotificationKey.
+func (c *GCMClient) CreateGroup(name string, ids ...string) (string, error) {
+	if len(ids) > GCMMaxGroupMembers {
+		return "", fmt.Errorf("%d registration ids, a group has at most %d", len(ids), GCMMaxGroupMembers)
+	}
+	return c.group(&gcmGroupOperation{Operation: "create", Name: name, RegistrationIDs: ids})
+}
+
+// AddToGroup adds the registration ids to the device group and returns
+// its notification key.
+func (c *GCMClient) AddToGroup(name, key string, ids ...string) (string, error) {
+	return c.group(&gcmGroupOperation{Operation: "add", Name: name, Key: key, RegistrationIDs: ids})
+}
+
+// RemoveFromGroup removes the registration ids from the device group and
+// returns its notification key. The group is deleted with its last
+// member.
+func (c *GCMClient) RemoveFromGroup(name, key string, ids ...string) (string, error) {
+	return c.group(&gcmGroupOperation{Operation: "remove", Name: name, Key: key, RegistrationIDs: ids})
+}
+
+// group sends the operation to the device group url.
+func (c *GCMClient) group(op *gcmGroupOperation) (string, error) {
+	if c.SenderID == "" {
+		return "", fmt.Errorf("sender id not provided")
+	}
+	if op.Name == "" || len(op.RegistrationIDs) == 0 {
+		return "", fmt.Errorf("%s needs a group name and registration ids", op.Operation)
+	}
+	j, err := json.Marshal(op)
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequest("POST", c.GroupURL, bytes.NewBuffer(j))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Add("Authorization", fmt.Sprintf("key=%s", c.key))
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("project_id", c.SenderID)
+
+	resp, err := c.http.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	ret := gcmGroupResponse{}
+	json.Unmarshal(body, &ret)
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == 429:
+		return "", ErrRetry
+	case resp.StatusCode != 200:
+		if ret.Error != "" {
+			return "", fmt.Errorf("%s group %s: %s", op.Operation, op.Name, ret.Error)
+		}
+		return "", fmt.Errorf("%s group %s: %s %s", op.Operation, op.Name, resp.Status, string(body))
+	case ret.Key == "":
+		return "", fmt.Errorf("%s group %s: no notification key", op.Operation, op.Name)
+	}
+	return ret.Key, nil
+}
@@ -0,0 +1,210 @@
+package hermes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// gcmGroupServer manages device groups and sends to them. Sends to a
+// group fail for members starting with "busy" or "gone", sent directly
+// "busy" members are Unavailable once and "gone" ones NotRegistered.
+type gcmGroupServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	groups map[string][]string
+	busy   map[string]int
+	direct [][]string
+}
+
+var GCMGroupServer *gcmGroupServer
+
+func init() {
+	GCMGroupServer = &gcmGroupServer{}
+	GCMGroupServer.reset()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/notification", GCMGroupServer.group)
+	mux.HandleFunc("/send", GCMGroupServer.send)
+	GCMGroupServer.Server = httptest.NewServer(mux)
+}
+
+// reset drops the groups and forgets the sends.
+func (s *gcmGroupServer) reset() {
+	s.mu.Lock()
+	s.groups = make(map[string][]string)
+	s.busy = make(map[string]int)
+	s.direct = nil
+	s.mu.Unlock()
+}
+
+func (s *gcmGroupServer) group(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("project_id") != "1234" || r.Header.Get("Authorization") != "key=abc" {
+		w.WriteHeader(401)
+		return
+	}
+	op := gcmGroupOperation{}
+	json.NewDecoder(r.Body).Decode(&op)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := "key-" + op.Name
+	members, ok := s.groups[key]
+	switch {
+	case op.Operation == "create" && ok:
+		w.WriteHeader(400)
+		fmt.Fprintln(w, `{"error":"notification_key already exists"}`)
+		return
+	case op.Operation != "create" && (!ok || op.Key != key):
+		w.WriteHeader(400)
+		fmt.Fprintln(w, `{"error":"notification_key not found"}`)
+		return
+	case op.Operation == "remove":
+		kept := []string{}
+		for _, member := range members {
+			if !gcmGroupHas(op.RegistrationIDs, member) {
+				kept = append(kept, member)
+			}
+		}
+		members = kept
+	default:
+		members = append(members, op.RegistrationIDs...)
+	}
+	s.groups[key] = members
+	fmt.Fprintf(w, `{"notification_key":%q}`, key)
+}
+
+func gcmGroupHas(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *gcmGroupServer) send(w http.ResponseWriter, r *http.Request) {
+	m := GCMMessage{}
+	json.NewDecoder(r.Body).Decode(&m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.NotificationKey != "" {
+		failed := []string{}
+		for _, member := range s.groups[m.NotificationKey] {
+			if strings.HasPrefix(member, "busy") || strings.HasPrefix(member, "gone") {
+				failed = append(failed, member)
+			}
+		}
+		b, _ := json.Marshal(failed)
+		fmt.Fprintf(w, `{"success":%d,"failure":%d,"failed_registration_ids":%s}`, len(s.groups[m.NotificationKey])-len(failed), len(failed), b)
+		return
+	}
+	s.direct = append(s.direct, m.RegistrationIDs)
+	results := []string{}
+	for _, id := range m.RegistrationIDs {
+		switch {
+		case strings.HasPrefix(id, "busy") && s.busy[id] == 0:
+			s.busy[id]++
+			results = append(results, `{"error":"Unavailable"}`)
+		case strings.HasPrefix(id, "gone"):
+			results = append(results, `{"error":"NotRegistered"}`)
+		default:
+			results = append(results, `{"message_id":"1"}`)
+		}
+	}
+	fmt.Fprintf(w, `{"results":[%s]}`, strings.Join(results, ","))
+}
+
+func TestGCMGroups(t *testing.T) {
+	GCMGroupServer.reset()
+	c, _ := NewGCMClient(GCMGroupServer.URL+"/send", "abc", "")
+	if c.GroupURL != GCMGroupServer.URL+"/notification" {
+		t.Fatalf("unexpected group url %s", c.GroupURL)
+	}
+	if _, err := c.CreateGroup("user", "1"); err == nil {
+		t.Fatal("expected error without sender id")
+	}
+	c.SenderID = "1234"
+
+	key, err := c.CreateGroup("user", "1", "2")
+	if err != nil || key != "key-user" {
+		t.Fatalf("unexpected create %q %v", key, err)
+	}
+	if _, err = c.CreateGroup("user", "3"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected exists error got %v", err)
+	}
+	if _, err = c.CreateGroup("big", make([]string, GCMMaxGroupMembers+1)...); err == nil {
+		t.Fatal("expected too many members")
+	}
+	if _, err = c.AddToGroup("user", key, "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.RemoveFromGroup("user", key, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.AddToGroup("other", "key-other", "3"); err == nil {
+		t.Fatal("expected unknown group")
+	}
+	if got := GCMGroupServer.groups[key]; len(got) != 2 || got[0] != "2" || got[1] != "3" {
+		t.Fatalf("unexpected members %v", got)
+	}
+}
+
+func TestGCMSendGroup(t *testing.T) {
+	GCMGroupServer.reset()
+	c, _ := NewGCMClient(GCMGroupServer.URL+"/send", "abc", "")
+	c.SenderID = "1234"
+
+	key, _ := c.CreateGroup("ok", "1", "2")
+	resp, err := c.Send(&GCMMessage{NotificationKey: key})
+	if err != nil || resp.Success != 2 || resp.Failure != 0 {
+		t.Fatalf("unexpected response %v %+v", err, resp)
+	}
+
+	// Without a ResendPolicy the failed members are left to the caller.
+	key, _ = c.CreateGroup("throttled", "1", "busy0")
+	resp, err = c.Send(&GCMMessage{NotificationKey: key})
+	if err != ErrRetry || resp.Retry() < 0 || len(resp.FailedRegistrationIDs) != 1 || resp.Success != 1 || resp.Failure != 1 {
+		t.Fatalf("expected busy0 left to retry got %v %+v", err, resp)
+	}
+	if len(GCMGroupServer.direct) != 0 {
+		t.Fatalf("expected nothing sent directly got %v", GCMGroupServer.direct)
+	}
+	c.ResendPolicy = &RetryPolicy{Base: 1, MaxAttempts: 3}
+
+	// busy is sent again until it succeeds.
+	key, _ = c.CreateGroup("busy", "1", "busy1")
+	resp, err = c.Send(&GCMMessage{NotificationKey: key})
+	if err != nil || resp.Success != 2 || resp.Failure != 0 || len(resp.FailedRegistrationIDs) != 0 {
+		t.Fatalf("unexpected response %v %+v", err, resp)
+	}
+	if len(GCMGroupServer.direct) != 2 || GCMGroupServer.direct[0][0] != "busy1" {
+		t.Fatalf("expected busy1 sent directly twice got %v", GCMGroupServer.direct)
+	}
+
+	// gone is not registered, the caller removes it from the group.
+	key, _ = c.CreateGroup("gone", "1", "busy2", "gone1")
+	s := NewMemoryTokenStore()
+	s.Add(PlatformGCM, "gone1")
+	c.Tokens = s
+	resp, err = c.Send(&GCMMessage{NotificationKey: key})
+	if err != ErrRemoveToken || resp.Success != 2 || resp.Failure != 1 {
+		t.Fatalf("unexpected response %v %+v", err, resp)
+	}
+	if len(resp.Results) != 2 || resp.CanonicalIDs != 0 {
+		t.Fatalf("expected the results of the resent members %+v", resp)
+	}
+	if len(resp.FailedRegistrationIDs) != 1 || resp.RemoveIDs()[0] != "gone1" || !resp.UpdateToken() {
+		t.Fatalf("expected gone1 to be removed %+v", resp)
+	}
+	if _, ok, _ := s.Lookup(PlatformGCM, "gone1"); ok {
+		t.Fatal("expected gone1 removed from the store")
+	}
+
+	if err = (&GCMMessage{NotificationKey: key, To: GCMTopic("news")}).Validate(); err == nil {
+		t.Fatal("expected a single target")
+	}
+}
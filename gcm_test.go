@@ -6,7 +6,10 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -110,3 +113,340 @@ func TestGCMAddRecipients(t *testing.T) {
 		t.Fatal("registration ids not set")
 	}
 }
+
+// gcmBatchServer answers each registration id by prefix: "u" is
+// Unavailable the first time it is sent, "c" has a canonical id, "n"
+// is NotRegistered and a batch with "fail" fails as a whole with a 503,
+// one with "once" with a 503 and Retry-After of a second the first time,
+// one with "deny" with a 401 and one with "drop" has its connection
+// closed. It records the ids of every request.
+type gcmBatchServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests [][]string
+	sent     map[string]int
+}
+
+var GCMBatchServer *gcmBatchServer
+
+func init() {
+	GCMBatchServer = &gcmBatchServer{}
+	GCMBatchServer.reset()
+	GCMBatchServer.Server = httptest.NewServer(http.HandlerFunc(GCMBatchServer.send))
+}
+
+// reset forgets the requests and what was sent.
+func (s *gcmBatchServer) reset() {
+	s.mu.Lock()
+	s.requests = nil
+	s.sent = make(map[string]int)
+	s.mu.Unlock()
+}
+
+// received returns the ids of every request so far.
+func (s *gcmBatchServer) received() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *gcmBatchServer) send(w http.ResponseWriter, r *http.Request) {
+	m := GCMMessage{}
+	err := json.NewDecoder(r.Body).Decode(&m)
+	if err != nil || len(m.RegistrationIDs) > GCMMaxRecipients {
+		w.WriteHeader(400)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, m.RegistrationIDs)
+	resp := GCMResponse{MulticastID: 1}
+	for _, id := range m.RegistrationIDs {
+		if strings.HasPrefix(id, "once") && s.sent[id] == 0 {
+			s.sent[id]++
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(503)
+			return
+		}
+		switch id {
+		case "fail":
+			w.WriteHeader(503)
+			return
+		case "deny":
+			w.WriteHeader(401)
+			return
+		case "drop":
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		s.sent[id]++
+		result := &GCMResult{MessageID: id}
+		switch {
+		case strings.HasPrefix(id, "u") && s.sent[id] == 1:
+			result = &GCMResult{Error: "Unavailable"}
+		case strings.HasPrefix(id, "c"):
+			result.RegistrationID = "new-" + id
+		case strings.HasPrefix(id, "n"):
+			result = &GCMResult{Error: "NotRegistered"}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestGCMSendBatches(t *testing.T) {
+	GCMBatchServer.reset()
+	c, _ := NewGCMClient(GCMBatchServer.URL, "abc", "")
+	c.ResendPolicy = &RetryPolicy{Base: time.Millisecond, MaxAttempts: 3}
+
+	m := NewGCMMessage()
+	for i := 0; i < 2500; i++ {
+		prefix := "ok"
+		switch i {
+		case 10, 1500:
+			prefix = "u"
+		case 2400:
+			prefix = "c"
+		}
+		m.AddRecipients(fmt.Sprintf("%s%d", prefix, i))
+	}
+	r, err := c.Send(m)
+	if err != ErrUpdateToken {
+		t.Fatalf("expected update token got %v", err)
+	}
+	if len(r.Results) != 2500 || r.Success != 2500 || r.Failure != 0 || r.CanonicalIDs != 1 {
+		t.Fatalf("unexpected totals %d %d %d %d", len(r.Results), r.Success, r.Failure, r.CanonicalIDs)
+	}
+	for i, result := range r.Results {
+		if result.MessageID != m.RegistrationIDs[i] {
+			t.Fatalf("result %d out of order %+v", i, result)
+		}
+	}
+	if r.Results[2400].RegistrationID != "new-c2400" {
+		t.Fatalf("canonical id not merged %+v", r.Results[2400])
+	}
+
+	reqs := GCMBatchServer.received()
+	if len(reqs) != 4 {
+		t.Fatalf("expected 3 batches and a retry got %d requests", len(reqs))
+	}
+	retry := reqs[3]
+	if len(retry) != 2 || retry[0] != "u10" || retry[1] != "u1500" {
+		t.Fatalf("expected only the unavailable ids retried got %v", retry)
+	}
+}
+
+func TestGCMSendBatchFailure(t *testing.T) {
+	GCMBatchServer.reset()
+	c, _ := NewGCMClient(GCMBatchServer.URL, "abc", "")
+
+	m := NewGCMMessage()
+	for i := 0; i < 1500; i++ {
+		m.AddRecipients(fmt.Sprintf("n%d", i))
+	}
+	m.RegistrationIDs[1200] = "fail"
+	r, err := c.Send(m)
+	if err != ErrRetry || r.Retry() < 0 {
+		t.Fatalf("expected retry got %v", err)
+	}
+	if r.Results[0].Error != "NotRegistered" || r.Results[1200].Error != "Unavailable" {
+		t.Fatalf("unexpected results %+v %+v", r.Results[0], r.Results[1200])
+	}
+	if r.Failure != 1500 {
+		t.Fatalf("expected 1500 failures got %d", r.Failure)
+	}
+}
+
+// TestGCMSendBatchTransport checks the delivered batch's results are
+// kept when the other one fails without a response.
+func TestGCMSendBatchTransport(t *testing.T) {
+	GCMBatchServer.reset()
+	c, _ := NewGCMClient(GCMBatchServer.URL, "abc", "")
+
+	for _, test := range []struct {
+		failed  string
+		outcome GCMOutcome
+		err     func(error) bool
+	}{
+		{"drop", GCMUnavailable, func(err error) bool { return err == ErrRetry }},
+		{"deny", GCMOtherError, func(err error) bool { return err != nil && strings.Contains(err.Error(), "unauthorized") }},
+	} {
+		m := NewGCMMessage()
+		for i := 0; i < 2000; i++ {
+			m.AddRecipients(fmt.Sprintf("ok%d", i))
+		}
+		m.RegistrationIDs[1500] = test.failed
+		r, err := c.Send(m)
+		if r == nil || !test.err(err) {
+			t.Fatalf("%s: unexpected error %v", test.failed, err)
+		}
+		if len(r.Results) != 2000 || r.Success != 1000 || r.Failure != 1000 {
+			t.Fatalf("%s: unexpected totals %d %d %d", test.failed, len(r.Results), r.Success, r.Failure)
+		}
+		if r.Results[999].MessageID != "ok999" || r.Results[1000].Outcome() != test.outcome {
+			t.Fatalf("%s: unexpected results %+v %+v", test.failed, r.Results[999], r.Results[1000])
+		}
+		if test.outcome == GCMUnavailable && len(r.RetryIDs()) != 1000 {
+			t.Fatalf("%s: expected the failed batch retried got %d", test.failed, len(r.RetryIDs()))
+		}
+	}
+	// Without a ResendPolicy nothing was sent again.
+	if reqs := GCMBatchServer.received(); len(reqs) != 4 {
+		t.Fatalf("expected 2 batches a send got %d requests", len(reqs))
+	}
+}
+
+// TestGCMSendResendRetry checks recipients of a request the service
+// asked to retry are resent after its Retry-After.
+func TestGCMSendResendRetry(t *testing.T) {
+	GCMBatchServer.reset()
+	c, _ := NewGCMClient(GCMBatchServer.URL, "abc", "")
+	c.ResendPolicy = &RetryPolicy{Base: time.Millisecond, MaxAttempts: 3}
+
+	start := time.Now()
+	r, err := c.Send(NewGCMMessage("ok1", "once1"))
+	if err != nil || r.Success != 2 || r.Results[1].MessageID != "once1" {
+		t.Fatalf("expected the request resent got %v %+v", err, r)
+	}
+	if time.Since(start) < time.Second {
+		t.Fatal("expected the Retry-After waited for")
+	}
+
+	m := NewGCMMessage()
+	for i := 0; i < 1500; i++ {
+		m.AddRecipients(fmt.Sprintf("ok%d", i))
+	}
+	m.RegistrationIDs[1200] = "once2"
+	r, err = c.Send(m)
+	if err != nil || r.Success != 1500 || r.Failure != 0 || r.Results[1200].MessageID != "once2" {
+		t.Fatalf("expected the failed batch resent got %v %d %d", err, r.Success, r.Failure)
+	}
+	if reqs := GCMBatchServer.received(); len(reqs) != 5 || len(reqs[4]) != 500 {
+		t.Fatalf("expected only the failed batch resent got %d requests", len(reqs))
+	}
+}
+
+func TestGCMSendNoResend(t *testing.T) {
+	GCMBatchServer.reset()
+	c, _ := NewGCMClient(GCMBatchServer.URL, "abc", "")
+
+	start := time.Now()
+	r, err := c.Send(NewGCMMessage("ok1", "u2"))
+	if err != ErrRetry || r.Retry() < 0 || len(r.RetryIDs()) != 1 || r.RetryIDs()[0] != "u2" {
+		t.Fatalf("expected u2 left to retry got %v %+v", err, r)
+	}
+	if len(GCMBatchServer.received()) != 1 || time.Since(start) > time.Second {
+		t.Fatal("expected a single request without waiting")
+	}
+}
+
+func TestGCMOutcomes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"multicast_id":1,"success":2,"failure":5,"canonical_ids":1,"results":[
+			{"message_id":"1"},
+			{"message_id":"2","registration_id":"new"},
+			{"error":"NotRegistered"},
+			{"error":"InvalidRegistration"},
+			{"error":"MismatchSenderId"},
+			{"error":"DeviceMessageRateExceeded"},
+			{"error":"InvalidTtl"}
+		]}`)
+	}))
+	defer srv.Close()
+	c, _ := NewGCMClient(srv.URL, "abc", "")
+
+	m := NewGCMMessage("ok", "old", "gone", "bad", "other", "busy", "ttl")
+	r, err := c.Send(m)
+	if err != ErrRetry || r.Retry() < 0 {
+		t.Fatalf("expected retry got %v %d", err, r.Retry())
+	}
+	if !r.UpdateToken() {
+		t.Fatal("expected tokens to update")
+	}
+
+	want := []GCMOutcome{GCMSuccess, GCMCanonical, GCMNotRegistered, GCMInvalidRegistration, GCMMismatchSenderID, GCMDeviceMessageRateExceeded, GCMOtherError}
+	for i, result := range r.Results {
+		if result.Outcome() != want[i] {
+			t.Errorf("result %d: expected %s got %s", i, want[i], result.Outcome())
+		}
+	}
+	if ids := r.RemoveIDs(); len(ids) != 2 || ids[0] != "gone" || ids[1] != "bad" {
+		t.Fatalf("unexpected remove ids %v", ids)
+	}
+	if ids := r.ReplaceIDs(); len(ids) != 1 || ids["old"] != "new" {
+		t.Fatalf("unexpected replace ids %v", ids)
+	}
+	if ids := r.RetryIDs(); len(ids) != 1 || ids[0] != "busy" {
+		t.Fatalf("unexpected retry ids %v", ids)
+	}
+
+	// Without anything to retry, removing has precedence over replacing.
+	tests := []struct {
+		results []*GCMResult
+		err     error
+	}{
+		{[]*GCMResult{{RegistrationID: "new"}, {Error: "NotRegistered"}}, ErrRemoveToken},
+		{[]*GCMResult{{RegistrationID: "new"}, {Error: "MessageTooBig"}}, ErrUpdateToken},
+		{[]*GCMResult{{MessageID: "1"}}, nil},
+	}
+	for _, test := range tests {
+		if err := (&GCMResponse{Results: test.results}).resultsError(); err != test.err {
+			t.Errorf("expected %v got %v", test.err, err)
+		}
+	}
+	err = (&GCMResponse{Results: []*GCMResult{{Error: "MessageTooBig"}}}).resultsError()
+	if err == nil || err.Error() != "gcm MessageTooBig" {
+		t.Fatalf("expected message too big got %v", err)
+	}
+}
+
+func TestGCMMessageValidate(t *testing.T) {
+	m := NewGCMMessage("1")
+	m.Priority = GCMPriorityHigh
+	m.ContentAvailable = true
+	m.Notification = &GCMNotification{Title: "hello", BodyLocKey: "BODY", BodyLocArgs: []string{"a"}, ClickAction: "OPEN"}
+	m.SetPayload("fromage", "brie")
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := m.Bytes()
+	got := map[string]interface{}{}
+	json.Unmarshal(b, &got)
+	if got["priority"] != "high" || got["content_available"] != true {
+		t.Fatalf("unexpected message %s", b)
+	}
+	notification := got["notification"].(map[string]interface{})
+	if notification["title"] != "hello" || notification["body_loc_key"] != "BODY" || notification["click_action"] != "OPEN" {
+		t.Fatalf("unexpected notification %s", b)
+	}
+	if _, ok := got["mutable_content"]; ok {
+		t.Fatalf("unset fields sent %s", b)
+	}
+
+	for _, key := range []string{"from", "notification", "message_type", "google.sent_time", "googleplay", "gcm.notification.e"} {
+		m := NewGCMMessage("1")
+		m.SetPayload(key, "a")
+		if err := m.Validate(); err == nil {
+			t.Errorf("expected %s to be reserved", key)
+		}
+	}
+	m = NewGCMMessage("1")
+	m.Priority = "urgent"
+	if err := m.Validate(); err == nil {
+		t.Fatal("expected unknown priority")
+	}
+	m = NewGCMMessage("1")
+	m.TimeToLive = gcmMaxTTL + 1
+	if err := m.Validate(); err == nil {
+		t.Fatal("expected time to live error")
+	}
+
+	c, _ := NewGCMClient(GCMServer.URL, "abc", "")
+	m.TimeToLive = 0
+	m.SetPayload("from", "a")
+	if _, err := c.Send(m); err == nil {
+		t.Fatal("expected send to validate")
+	}
+}
@@ -0,0 +1,191 @@
+package hermes
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// GCMMaxConditionTopics is the most topics a condition may use.
+const GCMMaxConditionTopics = 5
+
+const gcmTopicPrefix = "/topics/"
+
+// gcmTopicName is what a topic name may contain.
+var gcmTopicName = regexp.MustCompile(`^[a-zA-Z0-9-_.~%]+$`)
+
+// GCMTopic returns the GCMMessage.To of the topic.
+func GCMTopic(name string) string {
+	return gcmTopicPrefix + name
+}
+
+// GCMCondition is a condition expression of topics such as
+//
+//	'dogs' in topics && ('cats' in topics || !('birds' in topics))
+//
+// built with GCMTopicIn, GCMAnd, GCMOr and GCMNot.
+type GCMCondition string
+
+// GCMTopicIn matches devices subscribed to the topic.
+func GCMTopicIn(name string) GCMCondition {
+	return GCMCondition(fmt.Sprintf("'%s' in topics", name))
+}
+
+// GCMAnd matches devices matching every condition.
+func GCMAnd(conditions ...GCMCondition) GCMCondition {
+	return gcmJoin("&&", conditions)
+}
+
+// GCMOr matches devices matching any condition.
+func GCMOr(conditions ...GCMCondition) GCMCondition {
+	return gcmJoin("||", conditions)
+}
+
+// GCMNot matches devices not matching the condition.
+func GCMNot(c GCMCondition) GCMCondition {
+	return GCMCondition("!(" + string(c) + ")")
+}
+
+// gcmJoin wraps conditions using an operator in parentheses.
+func gcmJoin(op string, conditions []GCMCondition) GCMCondition {
+	parts := make([]string, len(conditions))
+	for i, c := range conditions {
+		parts[i] = string(c)
+		if len(conditions) > 1 && (strings.Contains(parts[i], "&&") || strings.Contains(parts[i], "||")) {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return GCMCondition(strings.Join(parts, " "+op+" "))
+}
+
+// Validate checks the syntax and the number of topics.
+func (c GCMCondition) Validate() error {
+	return ValidateGCMCondition(string(c))
+}
+
+// ValidateGCMCondition checks the condition is a valid expression of at
+// most GCMMaxConditionTopics topics, combined with &&, ||, ! and
+// parentheses.
+func ValidateGCMCondition(condition string) error {
+	tokens, err := gcmConditionTokens(condition)
+	if err != nil {
+		return err
+	}
+	p := &gcmConditionParser{tokens: tokens}
+	err = p.expr()
+	if err != nil {
+		return err
+	}
+	if p.pos < len(p.tokens) {
+		return fmt.Errorf("condition: unexpected %q", p.tokens[p.pos])
+	}
+	if p.topics > GCMMaxConditionTopics {
+		return fmt.Errorf("condition: %d topics, at most %d allowed", p.topics, GCMMaxConditionTopics)
+	}
+	return nil
+}
+
+// gcmConditionTokens splits the condition into operators, parentheses,
+// quoted topic names and words.
+func gcmConditionTokens(condition string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(condition); {
+		switch ch := condition[i]; {
+		case ch == ' ' || ch == '\t':
+			i++
+		case ch == '(' || ch == ')' || ch == '!':
+			tokens = append(tokens, string(ch))
+			i++
+		case strings.HasPrefix(condition[i:], "&&"), strings.HasPrefix(condition[i:], "||"):
+			tokens = append(tokens, condition[i:i+2])
+			i += 2
+		case ch == '\'' || ch == '"':
+			end := strings.IndexByte(condition[i+1:], ch)
+			if end < 0 {
+				return nil, fmt.Errorf("condition: unterminated topic at %d", i)
+			}
+			tokens = append(tokens, condition[i:i+end+2])
+			i += end + 2
+		default:
+			end := i
+			for end < len(condition) && strings.IndexByte(" \t()!&|'\"", condition[end]) < 0 {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("condition: unexpected %q at %d", ch, i)
+			}
+			tokens = append(tokens, condition[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// gcmConditionParser is a recursive descent parser of
+//
+//	expr   = term { "||" term }
+//	term   = factor { "&&" factor }
+//	factor = "!" factor | "(" expr ")" | topic "in" "topics"
+type gcmConditionParser struct {
+	tokens []string
+	pos    int
+	topics int
+}
+
+func (p *gcmConditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *gcmConditionParser) expr() error {
+	err := p.term()
+	for err == nil && p.peek() == "||" {
+		p.pos++
+		err = p.term()
+	}
+	return err
+}
+
+func (p *gcmConditionParser) term() error {
+	err := p.factor()
+	for err == nil && p.peek() == "&&" {
+		p.pos++
+		err = p.factor()
+	}
+	return err
+}
+
+func (p *gcmConditionParser) factor() error {
+	switch token := p.peek(); {
+	case token == "":
+		return fmt.Errorf("condition: unexpected end")
+	case token == "!":
+		p.pos++
+		return p.factor()
+	case token == "(":
+		p.pos++
+		err := p.expr()
+		if err != nil {
+			return err
+		}
+		if p.peek() != ")" {
+			return fmt.Errorf("condition: missing )")
+		}
+		p.pos++
+		return nil
+	case token[0] == '\'' || token[0] == '"':
+		name := token[1 : len(token)-1]
+		if !gcmTopicName.MatchString(name) {
+			return fmt.Errorf("condition: invalid topic %q", name)
+		}
+		if p.pos+2 >= len(p.tokens) || p.tokens[p.pos+1] != "in" || p.tokens[p.pos+2] != "topics" {
+			return fmt.Errorf("condition: expected in topics after %s", token)
+		}
+		p.pos += 3
+		p.topics++
+		return nil
+	}
+	return fmt.Errorf("condition: unexpected %q", p.peek())
+}
@@ -0,0 +1,117 @@
+package hermes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGCMCondition(t *testing.T) {
+	c := GCMAnd(GCMTopicIn("dogs"), GCMOr(GCMTopicIn("cats"), GCMNot(GCMTopicIn("birds"))))
+	want := `'dogs' in topics && ('cats' in topics || !('birds' in topics))`
+	if string(c) != want {
+		t.Fatalf("expected %s got %s", want, c)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if GCMTopic("news") != "/topics/news" {
+		t.Fatalf("unexpected topic %s", GCMTopic("news"))
+	}
+
+	valid := []string{
+		`'a' in topics`,
+		`"a" in topics||'b' in topics`,
+		`!'a' in topics && ('b' in topics || 'c' in topics) && 'd' in topics || 'e' in topics`,
+		`((('a-b_c.d~e%f' in topics)))`,
+	}
+	for _, s := range valid {
+		if err := ValidateGCMCondition(s); err != nil {
+			t.Errorf("expected %s valid got %v", s, err)
+		}
+	}
+	invalid := []string{
+		``,
+		`'a'`,
+		`'a' in`,
+		`'a' in apps`,
+		`'a in topics`,
+		`'a b' in topics`,
+		`'a' in topics &&`,
+		`'a' in topics & 'b' in topics`,
+		`('a' in topics`,
+		`'a' in topics)`,
+		`'a' in topics 'b' in topics`,
+		string(GCMOr(GCMTopicIn("a"), GCMTopicIn("b"), GCMTopicIn("c"), GCMTopicIn("d"), GCMTopicIn("e"), GCMTopicIn("f"))),
+	}
+	for _, s := range invalid {
+		if err := ValidateGCMCondition(s); err == nil {
+			t.Errorf("expected %s invalid", s)
+		}
+	}
+}
+
+func TestGCMMessageValidateTarget(t *testing.T) {
+	m := &GCMMessage{To: GCMTopic("news")}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m = &GCMMessage{Condition: string(GCMTopicIn("news"))}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := m.Bytes()
+	got := map[string]interface{}{}
+	json.Unmarshal(b, &got)
+	if _, ok := got["registration_ids"]; ok || got["condition"] != `'news' in topics` {
+		t.Fatalf("unexpected message %s", b)
+	}
+
+	for _, m := range []*GCMMessage{
+		{RegistrationIDs: []string{"1"}, To: GCMTopic("news")},
+		{To: GCMTopic("news"), Condition: string(GCMTopicIn("news"))},
+		{To: GCMTopic("bad news")},
+		{Condition: "'news' in topics ||"},
+	} {
+		if err := m.Validate(); err == nil {
+			t.Errorf("expected %+v invalid", m)
+		}
+	}
+}
+
+func TestGCMSendTopic(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := GCMMessage{}
+		json.NewDecoder(r.Body).Decode(&m)
+		if m.To == GCMTopic("busy") {
+			fmt.Fprintln(w, `{"error":"TopicsMessageRateExceeded"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"message_id":6177433633397011933}`)
+	}))
+	defer srv.Close()
+	c, _ := NewGCMClient(srv.URL, "abc", "")
+
+	resp, err := c.Send(&GCMMessage{To: GCMTopic("news"), Data: map[string]interface{}{"a": "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MessageID != "6177433633397011933" || resp.Success != 1 || resp.Retry() != -1 || resp.UpdateToken() {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	resp, err = c.Send(&GCMMessage{Condition: string(GCMTopicIn("news"))})
+	if err != nil || resp.MessageID == "" {
+		t.Fatalf("unexpected response %v %+v", err, resp)
+	}
+
+	resp, err = c.Send(&GCMMessage{To: GCMTopic("busy")})
+	if err != ErrRetry || resp.Retry() < 0 || resp.Failure != 1 {
+		t.Fatalf("expected retry got %v %+v", err, resp)
+	}
+	if resp.Results[0].Outcome() != GCMTopicsMessageRateExceeded {
+		t.Fatalf("unexpected outcome %s", resp.Results[0].Outcome())
+	}
+}
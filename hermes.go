@@ -16,9 +16,12 @@ var (
 	ErrTokenExpired = fmt.Errorf("token expired")
 )
 
-// Service is the interface for apns/gcm/c2dm/adm
+// Service is the interface for apns/gcm/c2dm/adm, see APNSService,
+// GCMService, ADMService and C2DMService.
 type Service interface {
-	Send() (*Response, error)
+	// Send delivers the notification to a device token. The response is
+	// nil only if the request couldn't be made.
+	Send(token string, n *Notification) (Response, error)
 }
 
 // Message is the json encoded message.
@@ -0,0 +1,113 @@
+package hermes
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+)
+
+// jwtSigner signs the jwt signing input and returns the raw signature.
+type jwtSigner func(input []byte) ([]byte, error)
+
+// encodeJWT returns the compact serialization of header and claims.
+func encodeJWT(header, claims interface{}, sign jwtSigner) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	sig, err := sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// es256Signer signs with the P-256 key, the signature is r || s as
+// required by JWS.
+func es256Signer(key *ecdsa.PrivateKey) jwtSigner {
+	return func(input []byte) ([]byte, error) {
+		digest := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	}
+}
+
+// verifyES256 checks the r || s signature of input.
+func verifyES256(pub *ecdsa.PublicKey, input, sig []byte) bool {
+	if len(sig) != 64 {
+		return false
+	}
+	digest := sha256.Sum256(input)
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	return ecdsa.Verify(pub, digest[:], r, s)
+}
+
+// parseECPrivateKey reads a PEM encoded PKCS#8 (or SEC 1) P-256 key,
+// such as the .p8 file downloaded from Apple.
+func parseECPrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is %T, not ecdsa", k)
+	}
+	return key, nil
+}
+
+// rs256Signer signs with RSASSA-PKCS1-v1_5 and SHA-256.
+func rs256Signer(key *rsa.PrivateKey) jwtSigner {
+	return func(input []byte) ([]byte, error) {
+		digest := sha256.Sum256(input)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+}
+
+// parseRSAPrivateKey reads a PEM encoded PKCS#8 (or PKCS#1) RSA key,
+// such as the private_key of a google service account.
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is %T, not rsa", k)
+	}
+	return key, nil
+}
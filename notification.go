@@ -0,0 +1,323 @@
+package hermes
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Priority of a notification.
+type Priority string
+
+// Priorities, the platform default is used if not set.
+const (
+	PriorityNormal Priority = "normal"
+	PriorityHigh   Priority = "high"
+)
+
+// NotificationDeepLinkKey is the data key the deep link is sent with.
+var NotificationDeepLinkKey = "url"
+
+// gcmMaxTTL is the longest time to live gcm accepts, 4 weeks.
+const gcmMaxTTL = 2419200
+
+// admMinTTL and admMaxTTL are the expiresAfter adm accepts, a minute to
+// 31 days.
+const (
+	admMinTTL = 60
+	admMaxTTL = 2678400
+)
+
+// apnsMaxCollapseID is the longest apns-collapse-id apns accepts.
+const apnsMaxCollapseID = 64
+
+// Notification is a platform neutral notification, each Service
+// translates it to its own message.
+type Notification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	// Badge and ClearBadge are only used by apns.
+	Badge       int                    `json:"badge,omitempty"`
+	ClearBadge  bool                   `json:"clearBadge,omitempty"`
+	Sound       string                 `json:"sound,omitempty"`
+	Data        map[string]interface{} `json:"data,omitempty"`
+	CollapseKey string                 `json:"collapseKey,omitempty"`
+	// TTL is how many seconds delivery is attempted for,
+	// 0 uses the platform default.
+	TTL      int      `json:"ttl,omitempty"`
+	Priority Priority `json:"priority,omitempty"`
+	// DeepLink is sent in the data as NotificationDeepLinkKey.
+	DeepLink  string                 `json:"deepLink,omitempty"`
+	Overrides *NotificationOverrides `json:"overrides,omitempty"`
+}
+
+// NotificationOverrides change the translated message of one platform.
+type NotificationOverrides struct {
+	// APNS replaces the translated aps dictionary.
+	APNS *APNSMessage `json:"apns,omitempty"`
+	// APNSData, GCMData, ADMData, C2DMData and FCMData are added to the
+	// data of the platform's message, replacing keys from
+	// Notification.Data.
+	APNSData map[string]interface{} `json:"apnsData,omitempty"`
+	GCMData  map[string]interface{} `json:"gcmData,omitempty"`
+	ADMData  map[string]string      `json:"admData,omitempty"`
+	C2DMData map[string]string      `json:"c2dmData,omitempty"`
+	FCMData  map[string]string      `json:"fcmData,omitempty"`
+}
+
+// TranslateError is returned when a notification field can't be
+// represented on a platform.
+type TranslateError struct {
+	Platform string
+	Field    string
+	Reason   string
+}
+
+// Error ...
+func (e *TranslateError) Error() string {
+	return fmt.Sprintf("%s: %s %s", e.Platform, e.Field, e.Reason)
+}
+
+// Bytes implements interface Message.
+func (n *Notification) Bytes() ([]byte, error) {
+	return json.Marshal(n)
+}
+
+// overrides never returns nil.
+func (n *Notification) overrides() *NotificationOverrides {
+	if n.Overrides == nil {
+		return &NotificationOverrides{}
+	}
+	return n.Overrides
+}
+
+// stringData returns Data, the deep link and overrides as strings for
+// adm and c2dm.
+func (n *Notification) stringData(platform string, overrides map[string]string) (map[string]string, error) {
+	data := map[string]string{}
+	for k, v := range n.Data {
+		val, ok := v.(string)
+		if !ok {
+			return nil, &TranslateError{platform, "data " + k, fmt.Sprintf("must be a string, got %T", v)}
+		}
+		data[k] = val
+	}
+	if n.Title != "" {
+		data["title"] = n.Title
+	}
+	if n.Body != "" {
+		data["body"] = n.Body
+	}
+	if n.Sound != "" {
+		data["sound"] = n.Sound
+	}
+	if n.DeepLink != "" {
+		data[NotificationDeepLinkKey] = n.DeepLink
+	}
+	for k, v := range overrides {
+		data[k] = v
+	}
+	return data, nil
+}
+
+// APNS translates the notification to an apns notification. Without
+// a title, body, badge or sound it is sent as a background update.
+func (n *Notification) APNS(token string) (*APNSPushNotification, error) {
+	o := n.overrides()
+
+	ap := o.APNS
+	if ap == nil {
+		ap = &APNSMessage{
+			Badge:      n.Badge,
+			ClearBadge: n.ClearBadge,
+		}
+		if n.Sound != "" {
+			ap.Sound = n.Sound
+		}
+		switch {
+		case n.Title != "":
+			ap.Alert = &APNSAlertDictionary{Title: n.Title, Body: n.Body}
+		case n.Body != "":
+			ap.Alert = n.Body
+		}
+		if ap.Alert == nil && ap.Sound == nil && ap.Badge == 0 && !ap.ClearBadge {
+			ap.ContentAvailable = 1
+		}
+	}
+
+	var expiry uint32
+	if n.TTL > 0 {
+		expiry = uint32(time.Now().Unix()) + uint32(n.TTL)
+	}
+	apn, err := NewAPNSPushNotification(token, ap, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case n.Priority == PriorityNormal, ap.ContentAvailable == 1 && ap.Alert == nil:
+		// Background updates must be sent with priority 5.
+		apn.Priority = 5
+	case n.Priority == PriorityHigh:
+		apn.Priority = 10
+	}
+	if len(n.CollapseKey) > apnsMaxCollapseID {
+		return nil, &TranslateError{"apns", "collapse key", fmt.Sprintf("longer than %d bytes", apnsMaxCollapseID)}
+	}
+	apn.CollapseID = n.CollapseKey
+
+	for k, v := range n.Data {
+		if k == "aps" {
+			return nil, &TranslateError{"apns", "data aps", "is reserved"}
+		}
+		apn.Set(k, v)
+	}
+	if n.DeepLink != "" {
+		apn.Set(NotificationDeepLinkKey, n.DeepLink)
+	}
+	for k, v := range o.APNSData {
+		if k == "aps" {
+			return nil, &TranslateError{"apns", "data aps", "is reserved"}
+		}
+		apn.Set(k, v)
+	}
+	return apn, nil
+}
+
+// GCM translates the notification to a gcm message for the ids.
+func (n *Notification) GCM(ids ...string) (*GCMMessage, error) {
+	if n.TTL > gcmMaxTTL {
+		return nil, &TranslateError{"gcm", "ttl", fmt.Sprintf("longer than %d seconds", gcmMaxTTL)}
+	}
+	m := NewGCMMessage(ids...)
+	if n.TTL > 0 {
+		m.TimeToLive = n.TTL
+	}
+	m.CollapseKey = n.CollapseKey
+	m.Priority = string(n.Priority)
+
+	for k, v := range n.Data {
+		m.Data[k] = v
+	}
+	if n.Title != "" {
+		m.Data["title"] = n.Title
+	}
+	if n.Body != "" {
+		m.Data["body"] = n.Body
+	}
+	if n.Sound != "" {
+		m.Data["sound"] = n.Sound
+	}
+	if n.DeepLink != "" {
+		m.Data[NotificationDeepLinkKey] = n.DeepLink
+	}
+	for k, v := range n.overrides().GCMData {
+		m.Data[k] = v
+	}
+	return m, nil
+}
+
+// ADM translates the notification to an adm message. adm data only
+// holds strings, other values are an error.
+func (n *Notification) ADM(id string) (*ADMMessage, error) {
+	data, err := n.stringData("adm", n.overrides().ADMData)
+	if err != nil {
+		return nil, err
+	}
+	if n.TTL > admMaxTTL {
+		return nil, &TranslateError{"adm", "ttl", fmt.Sprintf("longer than %d seconds", admMaxTTL)}
+	}
+	if n.TTL > 0 && n.TTL < admMinTTL {
+		return nil, &TranslateError{"adm", "ttl", fmt.Sprintf("shorter than %d seconds", admMinTTL)}
+	}
+	m := NewADMMessage(id)
+	m.Data = data
+	m.ConsolidationKey = n.CollapseKey
+	if n.TTL > 0 {
+		m.Expires = n.TTL
+	}
+	return m, nil
+}
+
+// C2DM translates the notification to a c2dm message. c2dm data only
+// holds strings, other values are an error.
+func (n *Notification) C2DM(id string) (*C2DMMessage, error) {
+	data, err := n.stringData("c2dm", n.overrides().C2DMData)
+	if err != nil {
+		return nil, err
+	}
+	m := NewC2DMMessage(id)
+	for k, v := range data {
+		m.Data[k] = v
+	}
+	m.CollapseKey = n.CollapseKey
+	return m, nil
+}
+
+// FCM translates the notification to an fcm message for the token, the
+// priority, ttl and collapse key go to the android and apns blocks. fcm
+// data only holds strings, other values are an error.
+func (n *Notification) FCM(token string) (*FCMMessage, error) {
+	if n.TTL > gcmMaxTTL {
+		return nil, &TranslateError{"fcm", "ttl", fmt.Sprintf("longer than %d seconds", gcmMaxTTL)}
+	}
+	m := &FCMMessage{Token: token}
+
+	data := map[string]string{}
+	for k, v := range n.Data {
+		val, ok := v.(string)
+		if !ok {
+			return nil, &TranslateError{"fcm", "data " + k, fmt.Sprintf("must be a string, got %T", v)}
+		}
+		data[k] = val
+	}
+	if n.DeepLink != "" {
+		data[NotificationDeepLinkKey] = n.DeepLink
+	}
+	for k, v := range n.overrides().FCMData {
+		data[k] = v
+	}
+	if len(data) > 0 {
+		m.Data = data
+	}
+	if n.Title != "" || n.Body != "" {
+		m.Notification = &FCMNotification{Title: n.Title, Body: n.Body}
+	}
+
+	android := &FCMAndroidConfig{
+		CollapseKey: n.CollapseKey,
+		Priority:    string(n.Priority),
+	}
+	if n.TTL > 0 {
+		android.TTL = FCMTTL(n.TTL)
+	}
+	if n.Sound != "" {
+		android.Notification = &FCMAndroidNotification{Sound: n.Sound}
+	}
+	m.Android = android
+
+	aps := map[string]interface{}{}
+	if n.Badge > 0 || n.ClearBadge {
+		aps["badge"] = n.Badge
+	}
+	if n.Sound != "" {
+		aps["sound"] = n.Sound
+	}
+	headers := map[string]string{}
+	switch n.Priority {
+	case PriorityNormal:
+		headers["apns-priority"] = "5"
+	case PriorityHigh:
+		headers["apns-priority"] = "10"
+	}
+	if n.CollapseKey != "" {
+		headers["apns-collapse-id"] = n.CollapseKey
+	}
+	if len(aps) > 0 || len(headers) > 0 {
+		m.APNS = &FCMAPNSConfig{Headers: headers}
+		if len(aps) > 0 {
+			m.APNS.Payload = map[string]interface{}{"aps": aps}
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,204 @@
+package hermes
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotificationAPNS(t *testing.T) {
+	n := &Notification{
+		Title:       "hello",
+		Body:        "world",
+		Badge:       2,
+		Sound:       "bingbong.aiff",
+		Data:        map[string]interface{}{"a": 1},
+		CollapseKey: "updates",
+		TTL:         3600,
+		Priority:    PriorityNormal,
+		DeepLink:    "app://inbox",
+	}
+	apn, err := n.APNS("E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(apn.payload)
+	want := `{"a":1,"aps":{"alert":{"title":"hello","body":"world"},"badge":2,"sound":"bingbong.aiff"},"url":"app://inbox"}`
+	if string(b) != want {
+		t.Fatalf("expected %s got %s", want, b)
+	}
+	if apn.Priority != 5 || apn.CollapseID != "updates" {
+		t.Fatalf("unexpected notification %+v", apn)
+	}
+	if apn.Expiry < uint32(time.Now().Unix()) {
+		t.Fatal("expiry not set")
+	}
+
+	// Data only notifications are background updates.
+	apn, _ = (&Notification{Data: map[string]interface{}{"a": 1}, Priority: PriorityHigh}).APNS("ab")
+	if apn.Get("aps").(*APNSMessage).ContentAvailable != 1 || apn.Priority != 5 {
+		t.Fatalf("expected background update got %+v", apn)
+	}
+
+	n.Overrides = &NotificationOverrides{
+		APNS:     &APNSMessage{Alert: "override", Category: "INVITE"},
+		APNSData: map[string]interface{}{"a": 2},
+	}
+	apn, _ = n.APNS("ab")
+	b, _ = json.Marshal(apn.payload)
+	want = `{"a":2,"aps":{"alert":"override","category":"INVITE"},"url":"app://inbox"}`
+	if string(b) != want {
+		t.Fatalf("expected %s got %s", want, b)
+	}
+
+	_, err = (&Notification{Data: map[string]interface{}{"aps": 1}}).APNS("ab")
+	if _, ok := err.(*TranslateError); !ok {
+		t.Fatalf("expected translate error got %v", err)
+	}
+	_, err = (&Notification{CollapseKey: strings.Repeat("a", 65)}).APNS("ab")
+	if _, ok := err.(*TranslateError); !ok {
+		t.Fatalf("expected translate error got %v", err)
+	}
+}
+
+func TestNotificationGCM(t *testing.T) {
+	n := &Notification{
+		Title:       "hello",
+		Data:        map[string]interface{}{"a": 1},
+		CollapseKey: "updates",
+		TTL:         60,
+		DeepLink:    "app://inbox",
+		Overrides:   &NotificationOverrides{GCMData: map[string]interface{}{"b": "c"}},
+	}
+	m, err := n.GCM("1", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.RegistrationIDs) != 2 || m.TimeToLive != 60 || m.CollapseKey != "updates" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	if m.Data["title"] != "hello" || m.Data["a"] != 1 || m.Data["b"] != "c" || m.Data["url"] != "app://inbox" {
+		t.Fatalf("unexpected data %+v", m.Data)
+	}
+
+	// Data only notifications are sent as they are.
+	m, _ = (&Notification{Data: map[string]interface{}{"a": 1}, Priority: PriorityHigh}).GCM("1")
+	if m.ContentAvailable || m.Priority != GCMPriorityHigh {
+		t.Fatalf("expected a high priority data message got %+v", m)
+	}
+
+	_, err = (&Notification{TTL: gcmMaxTTL + 1}).GCM("1")
+	if _, ok := err.(*TranslateError); !ok {
+		t.Fatalf("expected translate error got %v", err)
+	}
+}
+
+func TestNotificationADM(t *testing.T) {
+	n := &Notification{
+		Body:        "world",
+		Data:        map[string]interface{}{"a": "b"},
+		CollapseKey: "updates",
+		TTL:         60,
+		Overrides:   &NotificationOverrides{ADMData: map[string]string{"a": "c"}},
+	}
+	m, err := n.ADM("amzn1.adm-registration.v1.123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.RegistrationID != "amzn1.adm-registration.v1.123" || m.ConsolidationKey != "updates" || m.Expires != 60 {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	if m.Data["body"] != "world" || m.Data["a"] != "c" {
+		t.Fatalf("unexpected data %+v", m.Data)
+	}
+
+	// Without a ttl adm's default is used.
+	n.TTL = 0
+	m, err = n.ADM("amzn1.adm-registration.v1.123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := m.Bytes(); strings.Contains(string(b), "expiresAfter") {
+		t.Fatalf("expected no expiresAfter got %s", b)
+	}
+	for _, ttl := range []int{30, admMaxTTL + 1} {
+		n.TTL = ttl
+		_, err = n.ADM("amzn1.adm-registration.v1.123")
+		if terr, ok := err.(*TranslateError); !ok || terr.Platform != "adm" || terr.Field != "ttl" {
+			t.Fatalf("%d: expected translate error got %v", ttl, err)
+		}
+	}
+	n.TTL = 0
+
+	n.Data["n"] = 1
+	_, err = n.ADM("amzn1.adm-registration.v1.123")
+	terr, ok := err.(*TranslateError)
+	if !ok || terr.Platform != "adm" || terr.Field != "data n" {
+		t.Fatalf("expected translate error got %v", err)
+	}
+}
+
+func TestNotificationC2DM(t *testing.T) {
+	n := &Notification{Title: "hello", Data: map[string]interface{}{"a": "b"}}
+	m, err := n.C2DM("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Data["title"] != "hello" || m.Data["a"] != "b" {
+		t.Fatalf("unexpected data %+v", m.Data)
+	}
+
+	n.Data["n"] = true
+	_, err = n.C2DM("abc")
+	if _, ok := err.(*TranslateError); !ok {
+		t.Fatalf("expected translate error got %v", err)
+	}
+}
+
+func TestNotificationBytes(t *testing.T) {
+	n := &Notification{Title: "hello", Priority: PriorityHigh, Data: map[string]interface{}{"a": "b"}}
+	b, err := n.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Notification{}
+	err = json.Unmarshal(b, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "hello" || got.Priority != PriorityHigh || got.Data["a"] != "b" {
+		t.Fatalf("unexpected notification %+v", got)
+	}
+}
+
+func TestNotificationFCM(t *testing.T) {
+	n := &Notification{
+		Title:     "hello",
+		Sound:     "default",
+		TTL:       60,
+		DeepLink:  "app://inbox",
+		Data:      map[string]interface{}{"a": "b"},
+		Overrides: &NotificationOverrides{FCMData: map[string]string{"a": "c"}},
+	}
+	m, err := n.FCM("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Token != "abc" || m.Notification.Title != "hello" || m.Android.TTL != "60s" || m.Android.Notification.Sound != "default" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	if m.Data["a"] != "c" || m.Data["url"] != "app://inbox" {
+		t.Fatalf("unexpected data %+v", m.Data)
+	}
+	b, _ := json.Marshal(m.APNS)
+	if string(b) != `{"payload":{"aps":{"sound":"default"}}}` {
+		t.Fatalf("unexpected apns block %s", b)
+	}
+
+	n.Data["n"] = 1
+	_, err = n.FCM("abc")
+	if _, ok := err.(*TranslateError); !ok {
+		t.Fatalf("expected translate error got %v", err)
+	}
+}
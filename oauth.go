@@ -0,0 +1,83 @@
+package hermes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// oauthTokenLeeway refreshes access tokens this long before they expire.
+const oauthTokenLeeway = time.Minute
+
+// oauthAccessToken is the response of an oauth2 token endpoint.
+type oauthAccessToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+}
+
+// oauthToken caches the access token of an oauth2 token endpoint until
+// shortly before it expires. It is safe for concurrent use.
+type oauthToken struct {
+	http *http.Client
+
+	mu      sync.Mutex
+	access  string
+	expires time.Time
+}
+
+func newOAuthToken() oauthToken {
+	return oauthToken{http: &http.Client{Timeout: 20 * time.Second}}
+}
+
+// accessToken returns the cached access token, posting the form made by
+// form to endpoint once it is about to expire.
+func (t *oauthToken) accessToken(endpoint string, form func(now time.Time) (url.Values, error)) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.access != "" && now.Add(oauthTokenLeeway).Before(t.expires) {
+		return t.access, nil
+	}
+
+	values, err := form(now)
+	if err != nil {
+		return "", err
+	}
+	resp, err := t.http.PostForm(endpoint, values)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("token request %s %s", resp.Status, string(body))
+	}
+	access := oauthAccessToken{}
+	err = json.Unmarshal(body, &access)
+	if err != nil {
+		return "", err
+	}
+	if access.AccessToken == "" {
+		return "", fmt.Errorf("token request returned no access token")
+	}
+	t.access = access.AccessToken
+	t.expires = now.Add(time.Duration(access.ExpiresIn) * time.Second)
+	return t.access, nil
+}
+
+// expire drops the cached token so the next request gets a new one.
+func (t *oauthToken) expire() {
+	t.mu.Lock()
+	t.access = ""
+	t.mu.Unlock()
+}
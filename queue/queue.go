@@ -0,0 +1,337 @@
+// Package queue sends notifications in the background with a pool of
+// workers per platform, retrying when the service asks to. A queue
+// opened with Open keeps its jobs in a write ahead log so they survive
+// restarts.
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkar/hermes"
+)
+
+// ErrClosed is returned by Enqueue after Close.
+var ErrClosed = fmt.Errorf("queue closed")
+
+// Job is a target waiting to be sent for an app.
+type Job struct {
+	ID       uint64         `json:"id"`
+	App      string         `json:"app"`
+	Target   *hermes.Target `json:"target"`
+	Attempts int            `json:"attempts"`
+	Created  time.Time      `json:"created"`
+}
+
+// Config ...
+type Config struct {
+	// Workers per platform, defaults to 4.
+	Workers int
+	// RetryPolicy sets the backoff and how long a job is retried,
+	// defaults to hermes.DefaultRetryPolicy. Clients retrying within
+	// a send, like a GCMClient with a ResendPolicy, would retry on top
+	// of it while holding a worker.
+	RetryPolicy *hermes.RetryPolicy
+	// OnResult is called once for every job when it succeeds,
+	// fails or runs out of attempts. Without a log it is also called
+	// with ErrClosed for the jobs whose retry Close gave up on.
+	OnResult func(j *Job, r *hermes.Result)
+}
+
+// Queue sends jobs with the services of a router.
+type Queue struct {
+	router *hermes.Router
+	config Config
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	closed  bool
+	nextID  uint64
+	pending int // jobs enqueued and not done, including waiting retries
+	retries map[*Job]*time.Timer
+	queues  map[hermes.Platform]chan *Job
+	workers sync.WaitGroup
+	wal     *WAL
+}
+
+// New returns a queue sending with r, config may be nil.
+func New(r *hermes.Router, config *Config) *Queue {
+	q := &Queue{
+		router:  r,
+		retries: make(map[*Job]*time.Timer),
+		queues:  make(map[hermes.Platform]chan *Job),
+	}
+	if config != nil {
+		q.config = *config
+	}
+	if q.config.Workers < 1 {
+		q.config.Workers = 4
+	}
+	if q.config.RetryPolicy == nil {
+		q.config.RetryPolicy = hermes.DefaultRetryPolicy
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Open returns a queue logging its jobs to dir. Jobs left from a
+// previous run are sent again.
+func Open(dir string, r *hermes.Router, config *Config) (*Queue, error) {
+	w, err := OpenWAL(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := New(r, config)
+	q.wal = w
+	q.nextID = w.LastID()
+
+	for _, e := range w.Pending() {
+		j, err := jobFromEntry(e)
+		if err != nil {
+			// Can't be sent, don't replay it again.
+			w.Ack(e.ID)
+			continue
+		}
+		q.mu.Lock()
+		q.pending++
+		ch := q.queue(j.Target.Platform)
+		q.mu.Unlock()
+		ch <- j
+	}
+	return q, nil
+}
+
+// newEntry returns the job as a put entry.
+func newEntry(j *Job) (*Entry, error) {
+	payload, err := j.Target.Notification.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{
+		ID:       j.ID,
+		App:      j.App,
+		Platform: j.Target.Platform,
+		Token:    j.Target.Token,
+		Attempts: j.Attempts,
+		Created:  j.Created,
+		Payload:  payload,
+	}, nil
+}
+
+// jobFromEntry ...
+func jobFromEntry(e *Entry) (*Job, error) {
+	n := &hermes.Notification{}
+	err := json.Unmarshal(e.Payload, n)
+	if err != nil {
+		return nil, err
+	}
+	return &Job{
+		ID:  e.ID,
+		App: e.App,
+		Target: &hermes.Target{
+			Platform:     e.Platform,
+			Token:        e.Token,
+			Notification: n,
+		},
+		Attempts: e.Attempts,
+		Created:  e.Created,
+	}, nil
+}
+
+// Enqueue adds a target for the app to the queue. With a log it
+// returns once the job is written. Targets without a notification or
+// a service registered for their app and platform are rejected.
+func (q *Queue) Enqueue(app string, t *hermes.Target) error {
+	if t == nil || t.Notification == nil {
+		return fmt.Errorf("target without a notification")
+	}
+	_, err := q.router.Service(app, t.Platform)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrClosed
+	}
+	q.nextID++
+	j := &Job{
+		ID:      q.nextID,
+		App:     app,
+		Target:  t,
+		Created: time.Now(),
+	}
+	q.pending++
+	q.mu.Unlock()
+
+	if q.wal != nil {
+		e, err := newEntry(j)
+		if err == nil {
+			err = q.wal.Put(e)
+		}
+		if err != nil {
+			q.finish()
+			return err
+		}
+	}
+
+	q.mu.Lock()
+	ch := q.queue(t.Platform)
+	q.mu.Unlock()
+	ch <- j
+	return nil
+}
+
+// queue returns the channel for the platform, starting its workers
+// the first time. Must be called with mu held.
+func (q *Queue) queue(p hermes.Platform) chan *Job {
+	ch, ok := q.queues[p]
+	if ok {
+		return ch
+	}
+	ch = make(chan *Job, q.config.Workers*100)
+	q.queues[p] = ch
+	for i := 0; i < q.config.Workers; i++ {
+		q.workers.Add(1)
+		go q.work(ch)
+	}
+	return ch
+}
+
+// work sends jobs until the channel is closed.
+func (q *Queue) work(ch chan *Job) {
+	defer q.workers.Done()
+	for j := range ch {
+		j.Attempts++
+		r := q.router.SendOne(j.App, j.Target)
+		if r.Error != nil && r.Response != nil && r.Response.Retry() >= 0 {
+			after := time.Duration(r.Response.Retry()) * time.Second
+			delay, ok := q.config.RetryPolicy.Next(j.Attempts, j.Created, after)
+			if ok {
+				q.retry(j, delay)
+				continue
+			}
+		}
+		q.done(j, r)
+	}
+}
+
+// retry enqueues the job again after delay, once closed it is given
+// up on instead.
+func (q *Queue) retry(j *Job, delay time.Duration) {
+	if q.wal != nil {
+		// Keep the attempts across restarts, if this fails the job
+		// is still retried but a restart starts over.
+		e, err := newEntry(j)
+		if err == nil {
+			q.wal.Put(e)
+		}
+	}
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		q.abandon(j)
+		return
+	}
+	q.retries[j] = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		delete(q.retries, j)
+		if q.closed {
+			q.mu.Unlock()
+			q.abandon(j)
+			return
+		}
+		ch := q.queue(j.Target.Platform)
+		q.mu.Unlock()
+		ch <- j
+	})
+	q.mu.Unlock()
+}
+
+// abandon gives up on a job waiting to be retried. With a log it is
+// left there for Open to send again, otherwise it fails with ErrClosed.
+func (q *Queue) abandon(j *Job) {
+	if q.wal == nil && q.config.OnResult != nil {
+		q.config.OnResult(j, &hermes.Result{Target: j.Target, Error: ErrClosed})
+	}
+	q.finish()
+}
+
+// done reports the result and marks the job done.
+func (q *Queue) done(j *Job, r *hermes.Result) {
+	if q.wal != nil {
+		q.wal.Ack(j.ID)
+	}
+	if q.config.OnResult != nil {
+		q.config.OnResult(j, r)
+	}
+	q.finish()
+}
+
+// finish wakes Drain once nothing is pending.
+func (q *Queue) finish() {
+	q.mu.Lock()
+	q.pending--
+	if q.pending == 0 {
+		q.cond.Broadcast()
+	}
+	q.mu.Unlock()
+}
+
+// Pending returns the number of jobs not done yet.
+func (q *Queue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// Drain waits until every enqueued job is done, including retries.
+func (q *Queue) Drain() {
+	q.mu.Lock()
+	for q.pending > 0 {
+		q.cond.Wait()
+	}
+	q.mu.Unlock()
+}
+
+// Close stops accepting jobs, waits for the jobs queued or being sent
+// and stops the workers and log. Jobs waiting to be retried are given
+// up on rather than waited for: with a log they stay in it for Open to
+// send again, otherwise OnResult gets ErrClosed for them. Call Drain
+// first to wait for their retries.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	stopped := []*Job{}
+	for j, t := range q.retries {
+		// A timer that already fired abandons its job itself.
+		if t.Stop() {
+			stopped = append(stopped, j)
+		}
+		delete(q.retries, j)
+	}
+	q.mu.Unlock()
+
+	for _, j := range stopped {
+		q.abandon(j)
+	}
+	q.Drain()
+
+	q.mu.Lock()
+	for _, ch := range q.queues {
+		close(ch)
+	}
+	q.mu.Unlock()
+	q.workers.Wait()
+
+	if q.wal != nil {
+		q.wal.Close()
+	}
+}
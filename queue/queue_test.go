@@ -0,0 +1,296 @@
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkar/hermes"
+)
+
+// testService answers by token prefix: "retry" asks to be retried
+// right away until it has been sent 3 times, "fail" fails and anything
+// else succeeds.
+type testService struct {
+	mu    sync.Mutex
+	sends map[string]int
+}
+
+// Send implements interface hermes.Service.
+func (s *testService) Send(token string, n *hermes.Notification) (hermes.Response, error) {
+	s.mu.Lock()
+	s.sends[token]++
+	sends := s.sends[token]
+	s.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(token, "retry") && sends < 3:
+		return &hermes.GCMResponse{RetryAfter: 0, Error: hermes.ErrRetry}, hermes.ErrRetry
+	case strings.HasPrefix(token, "fail"):
+		return nil, fmt.Errorf("failed")
+	}
+	return &hermes.GCMResponse{RetryAfter: -1}, nil
+}
+
+func (s *testService) count(token string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sends[token]
+}
+
+// testRetryPolicy retries without waiting long.
+var testRetryPolicy = &hermes.RetryPolicy{Base: time.Millisecond, MaxAttempts: 5}
+
+func newTestQueue(config *Config) (*Queue, *testService) {
+	if config.RetryPolicy == nil {
+		config.RetryPolicy = testRetryPolicy
+	}
+	s := &testService{sends: make(map[string]int)}
+	r := hermes.NewRouter()
+	r.Register("app", hermes.PlatformGCM, s)
+	r.Register("app", hermes.PlatformAPNS, s)
+	return New(r, config), s
+}
+
+func TestQueue(t *testing.T) {
+	mu := sync.Mutex{}
+	results := map[string]*hermes.Result{}
+	attempts := map[string]int{}
+	q, s := newTestQueue(&Config{
+		Workers: 2,
+		OnResult: func(j *Job, r *hermes.Result) {
+			mu.Lock()
+			results[j.Target.Token] = r
+			attempts[j.Target.Token] = j.Attempts
+			mu.Unlock()
+		},
+	})
+
+	n := &hermes.Notification{Body: "hello"}
+	for i := 0; i < 50; i++ {
+		err := q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformGCM, Token: fmt.Sprintf("ok%d", i), Notification: n})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformAPNS, Token: "retry", Notification: n})
+	q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformAPNS, Token: "fail", Notification: n})
+	q.Drain()
+
+	if q.Pending() != 0 {
+		t.Fatalf("expected nothing pending got %d", q.Pending())
+	}
+	if len(results) != 52 {
+		t.Fatalf("expected 52 results got %d", len(results))
+	}
+	if results["retry"].Error != nil || attempts["retry"] != 3 || s.count("retry") != 3 {
+		t.Fatalf("expected retry to succeed on the 3rd attempt got %d %+v", attempts["retry"], results["retry"])
+	}
+	if results["fail"].Error == nil || s.count("fail") != 1 {
+		t.Fatal("fail should not be retried")
+	}
+
+	// Targets a worker can't send are rejected.
+	invalid := map[string]*hermes.Target{
+		"nil target":       nil,
+		"nil notification": {Platform: hermes.PlatformGCM, Token: "ok"},
+		"unknown platform": {Platform: hermes.Platform("sms"), Token: "ok", Notification: n},
+	}
+	for name, target := range invalid {
+		if err := q.Enqueue("app", target); err == nil {
+			t.Fatalf("expected error for %s", name)
+		}
+	}
+	if err := q.Enqueue("unknown", &hermes.Target{Platform: hermes.PlatformAPNS, Token: "ok", Notification: n}); err == nil {
+		t.Fatal("expected error for unknown app")
+	}
+	if q.Pending() != 0 {
+		t.Fatalf("expected nothing pending got %d", q.Pending())
+	}
+	q.Close()
+
+	err := q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformGCM, Token: "ok", Notification: n})
+	if err != ErrClosed {
+		t.Fatalf("expected closed got %v", err)
+	}
+}
+
+func TestQueueMaxAttempts(t *testing.T) {
+	var result *hermes.Result
+	q, s := newTestQueue(&Config{
+		RetryPolicy: &hermes.RetryPolicy{Base: time.Millisecond, MaxAttempts: 2},
+		OnResult:    func(j *Job, r *hermes.Result) { result = r },
+	})
+	q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformGCM, Token: "retry", Notification: &hermes.Notification{}})
+	q.Drain()
+	q.Close()
+
+	if s.count("retry") != 2 {
+		t.Fatalf("expected 2 attempts got %d", s.count("retry"))
+	}
+	if result == nil || result.Error != hermes.ErrRetry {
+		t.Fatalf("expected retry error got %+v", result)
+	}
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	var result *hermes.Result
+	q, s := newTestQueue(&Config{
+		RetryPolicy: &hermes.RetryPolicy{Base: time.Hour, MaxAge: time.Minute},
+		OnResult:    func(j *Job, r *hermes.Result) { result = r },
+	})
+	q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformGCM, Token: "retry", Notification: &hermes.Notification{}})
+	q.Close()
+
+	// Waiting an hour would be past the max age.
+	if s.count("retry") != 1 {
+		t.Fatalf("expected 1 attempt got %d", s.count("retry"))
+	}
+	if result == nil || result.Error != hermes.ErrRetry {
+		t.Fatalf("expected retry error got %+v", result)
+	}
+}
+
+// TestQueueCloseRetries checks Close doesn't wait for retries, they are
+// failed without a log and left in it with one.
+func TestQueueCloseRetries(t *testing.T) {
+	slow := &hermes.RetryPolicy{Base: time.Hour, MaxAttempts: 5}
+	results := make(chan *hermes.Result, 1)
+	q, s := newTestQueue(&Config{
+		RetryPolicy: slow,
+		OnResult:    func(j *Job, r *hermes.Result) { results <- r },
+	})
+	q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformGCM, Token: "retry", Notification: &hermes.Notification{}})
+	for s.count("retry") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	q.Close()
+	if time.Since(start) > time.Second {
+		t.Fatal("expected Close not to wait for the retry")
+	}
+	if r := <-results; r.Error != ErrClosed || q.Pending() != 0 {
+		t.Fatalf("expected the retry failed with ErrClosed got %+v", r)
+	}
+
+	dir, _ := ioutil.TempDir("", "hermes-queue")
+	defer os.RemoveAll(dir)
+	r := hermes.NewRouter()
+	r.Register("app", hermes.PlatformGCM, s)
+	q, err := Open(dir, r, &Config{
+		RetryPolicy: slow,
+		OnResult:    func(j *Job, r *hermes.Result) { t.Errorf("unexpected result %+v", r) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformGCM, Token: "retry", Notification: &hermes.Notification{}})
+	for s.count("retry") == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	q.Close()
+
+	w, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if p := w.Pending(); len(p) != 1 || p[0].Attempts != 1 {
+		t.Fatalf("expected the retry left in the log got %+v", p)
+	}
+}
+
+// blockingService waits for release before answering.
+type blockingService struct {
+	release chan struct{}
+}
+
+// Send implements interface hermes.Service.
+func (s *blockingService) Send(token string, n *hermes.Notification) (hermes.Response, error) {
+	<-s.release
+	return &hermes.GCMResponse{RetryAfter: -1}, nil
+}
+
+// copyDir copies the segments like a crash would leave them.
+func copyDir(t *testing.T, from string) string {
+	to, _ := ioutil.TempDir("", "hermes-queue-crash")
+	names, _ := filepath.Glob(filepath.Join(from, "*"))
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(to, filepath.Base(name)), b, 0644)
+	}
+	return to
+}
+
+func TestQueueOpen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hermes-queue")
+	defer os.RemoveAll(dir)
+
+	s := &blockingService{release: make(chan struct{})}
+	r := hermes.NewRouter()
+	r.Register("app", hermes.PlatformGCM, s)
+	q, err := Open(dir, r, &Config{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"1", "2", "3"} {
+		err = q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformGCM, Token: token, Notification: &hermes.Notification{Body: token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Crash while the jobs are in flight.
+	crashed := copyDir(t, dir)
+	defer os.RemoveAll(crashed)
+	close(s.release)
+	q.Close()
+
+	// Restart from the crashed state, the jobs are sent again.
+	sent := make(chan string, 3)
+	r = hermes.NewRouter()
+	r.Register("app", hermes.PlatformGCM, &testService{sends: make(map[string]int)})
+	q, err = Open(crashed, r, &Config{
+		OnResult: func(j *Job, r *hermes.Result) {
+			if j.Target.Notification.Body != j.Target.Token {
+				t.Errorf("notification not restored %+v", j.Target.Notification)
+			}
+			sent <- j.Target.Token
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	if len(sent) != 3 {
+		t.Fatalf("expected 3 jobs replayed got %d", len(sent))
+	}
+
+	// Everything was acked.
+	for _, d := range []string{dir, crashed} {
+		w, err := OpenWAL(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(w.Pending()) != 0 {
+			t.Fatalf("expected nothing pending in %s got %d", d, len(w.Pending()))
+		}
+		w.Close()
+	}
+
+	// New ids continue after the replayed ones.
+	q, _ = Open(crashed, r, nil)
+	q.Enqueue("app", &hermes.Target{Platform: hermes.PlatformGCM, Token: "4", Notification: &hermes.Notification{}})
+	q.Close()
+	if q.nextID != 4 {
+		t.Fatalf("expected id 4 got %d", q.nextID)
+	}
+}
@@ -0,0 +1,391 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkar/hermes"
+)
+
+// Record operations.
+const (
+	opPut        = 1 // add or update an entry
+	opAck        = 2 // the entry is done
+	opCheckpoint = 3 // starts a checkpoint, keeps the last id
+)
+
+// walHeaderSize is the length and crc32 of each record.
+const walHeaderSize = 8
+
+// DefaultSegmentSize is how much is appended before a checkpoint starts
+// a new segment.
+var DefaultSegmentSize int64 = 16 << 20
+
+// Entry is a job as stored in the log.
+type Entry struct {
+	Op       uint8           `json:"op"`
+	ID       uint64          `json:"id"`
+	App      string          `json:"app,omitempty"`
+	Platform hermes.Platform `json:"platform,omitempty"`
+	Token    string          `json:"token,omitempty"`
+	Attempts int             `json:"attempts,omitempty"`
+	Created  time.Time       `json:"created"`
+	// Payload is the serialized notification, see hermes.Message.
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// segmentFile is the segment being appended to, an *os.File.
+type segmentFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+// WAL is a write ahead log of entries in append only segment files.
+// Each record is written as
+//
+//	[4 bytes length, 4 bytes crc32, length bytes json entry]
+//
+// A checkpoint writes the entries not acked yet to a new segment and
+// removes the older ones, compacting the log.
+type WAL struct {
+	// SegmentSize triggers a checkpoint once that much was appended
+	// to the current segment, defaults to DefaultSegmentSize.
+	SegmentSize int64
+
+	mu        sync.Mutex
+	dir       string
+	segment   segmentFile
+	segmentID uint64
+	size      int64
+	// checkpointed is the size of the segment after the checkpoint.
+	checkpointed int64
+	lastID       uint64
+	pending      map[uint64]*Entry
+}
+
+// OpenWAL replays the segments in dir, creating it if needed, and
+// checkpoints them. A record cut off by a crash ends its segment,
+// which is truncated to the last complete record.
+func OpenWAL(dir string) (*WAL, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		SegmentSize: DefaultSegmentSize,
+		dir:         dir,
+		pending:     make(map[uint64]*Entry),
+	}
+
+	// Left by a crash during a checkpoint, the segments it was
+	// written from are still there.
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.wal.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+
+	ids, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		err = w.replay(id)
+		if err != nil {
+			return nil, err
+		}
+		w.segmentID = id
+	}
+
+	err = w.checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// segments returns the ids of the segment files in order.
+func (w *WAL) segments() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(w.dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint64{}
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".wal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// path of the segment file.
+func (w *WAL) path(id uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d.wal", id))
+}
+
+// replay applies the records of a segment to pending.
+func (w *WAL) replay(id uint64) error {
+	f, err := os.OpenFile(w.path(id), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for {
+		e, n, err := readRecord(f, fi.Size()-offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// Torn or corrupt write, drop it and everything after.
+			return f.Truncate(offset)
+		}
+		offset += n
+		w.apply(e)
+	}
+}
+
+// readRecord returns the entry and the bytes read, at most remaining so
+// a corrupt length can't make it allocate more than is left.
+func readRecord(r io.Reader, remaining int64) (*Entry, int64, error) {
+	header := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if int64(length) > remaining-walHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, 0, fmt.Errorf("checksum mismatch")
+	}
+	e := &Entry{}
+	err = json.Unmarshal(body, e)
+	if err != nil {
+		return nil, 0, err
+	}
+	return e, int64(walHeaderSize + length), nil
+}
+
+// encodeRecord ...
+func encodeRecord(e *Entry) ([]byte, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, walHeaderSize+len(body)))
+	binary.Write(buf, binary.BigEndian, uint32(len(body)))
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(body))
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// apply must be called with mu held.
+func (w *WAL) apply(e *Entry) {
+	if e.ID > w.lastID {
+		w.lastID = e.ID
+	}
+	switch e.Op {
+	case opPut:
+		w.pending[e.ID] = e
+	case opAck:
+		delete(w.pending, e.ID)
+	}
+}
+
+// checkpoint writes pending to a new segment and removes the older
+// ones. Must be called with mu held.
+func (w *WAL) checkpoint() error {
+	id := w.segmentID + 1
+	tmp := w.path(id) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	entries := append([]*Entry{{Op: opCheckpoint, ID: w.lastID}}, w.sorted()...)
+	for _, e := range entries {
+		b, err := encodeRecord(e)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, err = f.Write(b)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		size += int64(len(b))
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	err = os.Rename(tmp, w.path(id))
+	if err != nil {
+		return err
+	}
+
+	f, err = os.OpenFile(w.path(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if w.segment != nil {
+		w.segment.Close()
+	}
+	w.segment = f
+	w.segmentID = id
+	w.size = size
+	w.checkpointed = size
+
+	// The new segment has everything, the old ones can go.
+	ids, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, old := range ids {
+		if old < id {
+			os.Remove(w.path(old))
+		}
+	}
+	return nil
+}
+
+// sorted returns the pending entries by id.
+func (w *WAL) sorted() []*Entry {
+	ret := make([]*Entry, 0, len(w.pending))
+	for _, e := range w.pending {
+		ret = append(ret, e)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// append writes and syncs a record, checkpointing once SegmentSize has
+// been written since the last one.
+func (w *WAL) append(e *Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.segment == nil {
+		return fmt.Errorf("wal closed")
+	}
+
+	b, err := encodeRecord(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.segment.Write(b)
+	if err == nil {
+		err = w.segment.Sync()
+	}
+	if err != nil {
+		w.rollback()
+		return err
+	}
+	w.size += int64(len(b))
+	w.apply(e)
+
+	if w.size-w.checkpointed > w.SegmentSize {
+		return w.checkpoint()
+	}
+	return nil
+}
+
+// rollback drops a record that failed to be written or synced, on
+// replay it would end the segment and hide every record appended after
+// it. If the segment can't be truncated a checkpoint starts a new one,
+// failing that the log is closed. Must be called with mu held.
+func (w *WAL) rollback() {
+	if w.segment.Truncate(w.size) == nil {
+		return
+	}
+	if w.checkpoint() == nil {
+		return
+	}
+	w.segment.Close()
+	w.segment = nil
+}
+
+// Put adds or updates the entry.
+func (w *WAL) Put(e *Entry) error {
+	put := *e
+	put.Op = opPut
+	return w.append(&put)
+}
+
+// Ack marks the entry with id as done.
+func (w *WAL) Ack(id uint64) error {
+	return w.append(&Entry{Op: opAck, ID: id})
+}
+
+// Checkpoint compacts the log.
+func (w *WAL) Checkpoint() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.segment == nil {
+		return fmt.Errorf("wal closed")
+	}
+	return w.checkpoint()
+}
+
+// Pending returns the entries not acked yet, ordered by id.
+func (w *WAL) Pending() []*Entry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sorted()
+}
+
+// LastID is the highest id in the log.
+func (w *WAL) LastID() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastID
+}
+
+// Close ...
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.segment == nil {
+		return nil
+	}
+	err := w.segment.Close()
+	w.segment = nil
+	return err
+}
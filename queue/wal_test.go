@@ -0,0 +1,303 @@
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkar/hermes"
+)
+
+func testEntry(id uint64) *Entry {
+	n := &hermes.Notification{Body: "hello"}
+	payload, _ := n.Bytes()
+	return &Entry{
+		ID:       id,
+		App:      "app",
+		Platform: hermes.PlatformGCM,
+		Token:    "token",
+		Created:  time.Now(),
+		Payload:  payload,
+	}
+}
+
+// segmentFiles returns the segment paths in dir.
+func segmentFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func pendingIDs(w *WAL) []uint64 {
+	ids := []uint64{}
+	for _, e := range w.Pending() {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestWALReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hermes-wal")
+	defer os.RemoveAll(dir)
+
+	w, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := uint64(1); id <= 3; id++ {
+		err = w.Put(testEntry(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Ack(2)
+	e := testEntry(3)
+	e.Attempts = 2
+	w.Put(e)
+	w.Close()
+
+	w, err = OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	pending := w.Pending()
+	if len(pending) != 2 || pending[0].ID != 1 || pending[1].ID != 3 {
+		t.Fatalf("unexpected pending %v", pendingIDs(w))
+	}
+	if pending[1].Attempts != 2 || pending[1].Token != "token" || len(pending[1].Payload) == 0 {
+		t.Fatalf("entry not replayed %+v", pending[1])
+	}
+	if w.LastID() != 3 {
+		t.Fatalf("expected last id 3 got %d", w.LastID())
+	}
+	// Opening checkpoints, only one segment is left.
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected 1 segment got %v", files)
+	}
+}
+
+// TestWALTornWrite simulates a crash in the middle of appending the
+// last record, at different points of it.
+func TestWALTornWrite(t *testing.T) {
+	last, _ := encodeRecord(&Entry{Op: opPut, ID: 3})
+	for _, cut := range []int{1, 5, walHeaderSize, walHeaderSize + 1, len(last) - 1} {
+		dir, _ := ioutil.TempDir("", "hermes-wal")
+		defer os.RemoveAll(dir)
+
+		w, _ := OpenWAL(dir)
+		w.Put(&Entry{ID: 1})
+		w.Put(&Entry{ID: 2})
+		w.Close()
+		files := segmentFiles(t, dir)
+		fi, _ := os.Stat(files[0])
+		good := fi.Size()
+
+		// Write part of the third record and crash.
+		f, _ := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+		f.Write(last[:cut])
+		f.Close()
+
+		w, err := OpenWAL(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := pendingIDs(w)
+		if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+			t.Fatalf("cut %d: expected 1 and 2 pending got %v", cut, ids)
+		}
+		files = segmentFiles(t, dir)
+		fi, _ = os.Stat(files[0])
+		if fi.Size() != good {
+			t.Fatalf("cut %d: expected %d bytes got %d", cut, good, fi.Size())
+		}
+
+		// Appending works after recovery.
+		w.Put(&Entry{ID: 3})
+		w.Close()
+		w, _ = OpenWAL(dir)
+		ids = pendingIDs(w)
+		w.Close()
+		if len(ids) != 3 {
+			t.Fatalf("cut %d: expected 3 pending got %v", cut, ids)
+		}
+	}
+}
+
+func TestWALTornLastRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hermes-wal")
+	defer os.RemoveAll(dir)
+
+	w, _ := OpenWAL(dir)
+	w.Put(testEntry(1))
+	w.Put(testEntry(2))
+	w.Close()
+
+	files := segmentFiles(t, dir)
+	fi, _ := os.Stat(files[0])
+	os.Truncate(files[0], fi.Size()-3)
+
+	w, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ids := pendingIDs(w)
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("expected 1 pending got %v", ids)
+	}
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hermes-wal")
+	defer os.RemoveAll(dir)
+
+	w, _ := OpenWAL(dir)
+	w.Put(testEntry(1))
+	w.Put(testEntry(2))
+	w.Close()
+
+	// Flip a byte in the last record's body.
+	files := segmentFiles(t, dir)
+	b, _ := ioutil.ReadFile(files[0])
+	b[len(b)-2] ^= 0xff
+	ioutil.WriteFile(files[0], b, 0644)
+
+	w, _ = OpenWAL(dir)
+	defer w.Close()
+	ids := pendingIDs(w)
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("expected 1 pending got %v", ids)
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hermes-wal")
+	defer os.RemoveAll(dir)
+
+	w, _ := OpenWAL(dir)
+	w.SegmentSize = 1024
+	for id := uint64(1); id <= 50; id++ {
+		w.Put(testEntry(id))
+		if id != 25 {
+			w.Ack(id)
+		}
+	}
+
+	files := segmentFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 segment got %v", files)
+	}
+	fi, _ := os.Stat(files[0])
+	if fi.Size() > 2*w.SegmentSize {
+		t.Fatalf("segment not compacted, %d bytes", fi.Size())
+	}
+
+	// A crash after writing the checkpoint but before removing the old
+	// segments replays both, a crash while writing it leaves a tmp file.
+	w.Close()
+	b, _ := ioutil.ReadFile(files[0])
+	ioutil.WriteFile(w.path(w.segmentID-1), b, 0644)
+	ioutil.WriteFile(w.path(w.segmentID+1)+".tmp", []byte("partial"), 0644)
+
+	w2, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	ids := pendingIDs(w2)
+	if len(ids) != 1 || ids[0] != 25 {
+		t.Fatalf("expected 25 pending got %v", ids)
+	}
+	tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(tmps) != 0 {
+		t.Fatalf("tmp files not removed %v", tmps)
+	}
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected 1 segment got %v", files)
+	}
+}
+
+// failingSegment writes half of the next record and fails, like a full
+// disk. Truncate fails too if truncateErr is set.
+type failingSegment struct {
+	segmentFile
+	fail        bool
+	truncateErr error
+}
+
+func (f *failingSegment) Write(b []byte) (int, error) {
+	if !f.fail {
+		return f.segmentFile.Write(b)
+	}
+	f.fail = false
+	n, _ := f.segmentFile.Write(b[:len(b)/2])
+	return n, fmt.Errorf("no space left on device")
+}
+
+func (f *failingSegment) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+func TestWALFailedWrite(t *testing.T) {
+	for _, truncateErr := range []error{nil, fmt.Errorf("truncate failed")} {
+		dir, _ := ioutil.TempDir("", "hermes-wal")
+		defer os.RemoveAll(dir)
+
+		w, _ := OpenWAL(dir)
+		w.Put(testEntry(1))
+		w.segment = &failingSegment{segmentFile: w.segment, fail: true, truncateErr: truncateErr}
+		if err := w.Put(testEntry(2)); err == nil {
+			t.Fatal("expected write error")
+		}
+		// Appends after the failure aren't lost behind the partial record.
+		if err := w.Put(testEntry(3)); err != nil {
+			t.Fatal(err)
+		}
+		w.Ack(1)
+		w.Close()
+
+		w, err := OpenWAL(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := pendingIDs(w)
+		w.Close()
+		if len(ids) != 1 || ids[0] != 3 {
+			t.Fatalf("truncate error %v: expected 3 pending got %v", truncateErr, ids)
+		}
+	}
+}
+
+func TestWALCorruptLength(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hermes-wal")
+	defer os.RemoveAll(dir)
+
+	w, _ := OpenWAL(dir)
+	w.Put(testEntry(1))
+	w.Close()
+
+	// A header claiming a 4GB record.
+	files := segmentFiles(t, dir)
+	f, _ := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, '{'})
+	f.Close()
+
+	w, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ids := pendingIDs(w)
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("expected 1 pending got %v", ids)
+	}
+}
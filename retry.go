@@ -0,0 +1,110 @@
+package hermes
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides how long to wait before retrying a send and
+// when to give up. A nil policy uses DefaultRetryPolicy.
+type RetryPolicy struct {
+	// Base is the backoff before the first retry, doubled for every
+	// following attempt up to Max.
+	Base time.Duration
+	Max  time.Duration
+	// Jitter is the fraction of the backoff that is randomized, 0.5
+	// waits between half and all of it.
+	Jitter float64
+	// MaxAttempts is how often a notification is sent, 0 for no limit.
+	MaxAttempts int
+	// MaxAge stops retrying once this long passed since the first
+	// attempt, 0 for no limit.
+	MaxAge time.Duration
+}
+
+// DefaultRetryPolicy is used when a client or queue has no policy set.
+var DefaultRetryPolicy = &RetryPolicy{
+	Base:        time.Second,
+	Max:         5 * time.Minute,
+	Jitter:      0.5,
+	MaxAttempts: 5,
+	MaxAge:      24 * time.Hour,
+}
+
+// ParseRetryAfter parses a Retry-After value, either delta-seconds or
+// an HTTP-date, into the time left to wait from now.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if date.Before(now) {
+		return 0, true
+	}
+	return date.Sub(now), true
+}
+
+// Backoff returns the delay before the given retry, 1 is the first.
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	if p == nil {
+		p = DefaultRetryPolicy
+	}
+	if retry < 1 {
+		retry = 1
+	}
+	d := p.Base
+	for i := 1; i < retry && (p.Max <= 0 || d < p.Max); i++ {
+		d *= 2
+	}
+	if p.Max > 0 && d > p.Max {
+		d = p.Max
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// Next returns the delay before the next attempt after attempts sends,
+// the first at first. retryAfter is the delay asked for by the service,
+// used if longer than the backoff. It returns false once the attempts
+// or age are used up.
+func (p *RetryPolicy) Next(attempts int, first time.Time, retryAfter time.Duration) (time.Duration, bool) {
+	if p == nil {
+		p = DefaultRetryPolicy
+	}
+	if p.MaxAttempts > 0 && attempts >= p.MaxAttempts {
+		return 0, false
+	}
+	d := p.Backoff(attempts)
+	if retryAfter > d {
+		d = retryAfter
+	}
+	if p.MaxAge > 0 && time.Since(first)+d > p.MaxAge {
+		return 0, false
+	}
+	return d, true
+}
+
+// RetryAfter returns the seconds to wait for a Response, from the
+// Retry-After header if there is one, otherwise the first backoff.
+func (p *RetryPolicy) RetryAfter(h http.Header) int {
+	if d, ok := ParseRetryAfter(h.Get("Retry-After"), time.Now()); ok {
+		return int(math.Ceil(d.Seconds()))
+	}
+	return int(math.Ceil(p.Backoff(1).Seconds()))
+}
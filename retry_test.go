@@ -0,0 +1,131 @@
+package hermes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Wed, 21 Oct 2015 07:30:00 GMT", 2 * time.Minute, true},
+		{"Wed, 21 Oct 2015 07:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := ParseRetryAfter(test.value, now)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%q: expected %v %v got %v %v", test.value, test.want, test.ok, got, ok)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{Base: time.Second, Max: 10 * time.Second}
+	for retry, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		if got := p.Backoff(retry); got != want {
+			t.Errorf("retry %d: expected %v got %v", retry, want, got)
+		}
+	}
+	if got := p.Backoff(100); got != 10*time.Second {
+		t.Errorf("expected max got %v", got)
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got := p.Backoff(3)
+		if got < 2*time.Second || got > 4*time.Second {
+			t.Fatalf("jittered backoff %v out of range", got)
+		}
+	}
+}
+
+func TestRetryPolicyNext(t *testing.T) {
+	p := &RetryPolicy{Base: time.Second, MaxAttempts: 3, MaxAge: time.Minute}
+	now := time.Now()
+
+	d, ok := p.Next(1, now, 0)
+	if !ok || d != time.Second {
+		t.Fatalf("expected 1s got %v %v", d, ok)
+	}
+	// The service asked for longer.
+	d, ok = p.Next(2, now, 30*time.Second)
+	if !ok || d != 30*time.Second {
+		t.Fatalf("expected 30s got %v %v", d, ok)
+	}
+	if _, ok = p.Next(3, now, 0); ok {
+		t.Fatal("expected attempts used up")
+	}
+	if _, ok = p.Next(1, now, 2*time.Minute); ok {
+		t.Fatal("expected past max age")
+	}
+	if _, ok = p.Next(1, now.Add(-time.Hour), 0); ok {
+		t.Fatal("expected past max age")
+	}
+}
+
+func TestRetryAfterClients(t *testing.T) {
+	after := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if after != "" {
+			w.Header().Set("Retry-After", after)
+		}
+		w.WriteHeader(503)
+	}))
+	defer srv.Close()
+
+	policy := &RetryPolicy{Base: 3 * time.Second}
+	gcm, _ := NewGCMClient(srv.URL, "abc", "")
+	gcm.RetryPolicy = policy
+	adm, _ := NewADMClient(srv.URL, "abc")
+	adm.RetryPolicy = policy
+	c2dm, _ := NewC2DMClient(srv.URL, "abc")
+	c2dm.RetryPolicy = policy
+
+	send := map[string]func() (Response, error){
+		"gcm": func() (Response, error) {
+			m := NewGCMMessage("1")
+			m.SetPayload("a", "b")
+			return gcm.Send(m)
+		},
+		"adm": func() (Response, error) {
+			return adm.Send(NewADMMessage("amzn1.adm-registration.v1.123"))
+		},
+		"c2dm": func() (Response, error) {
+			m := NewC2DMMessage("1")
+			m.Data["a"] = "b"
+			return c2dm.Send(m)
+		},
+	}
+	tests := []struct {
+		after string
+		want  int
+	}{
+		{"", 3},
+		{"7", 7},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 60},
+	}
+	for _, test := range tests {
+		after = test.after
+		for name, fn := range send {
+			resp, err := fn()
+			if err != ErrRetry {
+				t.Fatalf("%s: expected retry got %v", name, err)
+			}
+			// The date has second precision.
+			if got := resp.Retry(); got < test.want-1 || got > test.want {
+				t.Errorf("%s %q: expected %d got %d", name, test.after, test.want, got)
+			}
+		}
+	}
+}
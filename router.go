@@ -0,0 +1,177 @@
+package hermes
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Platform identifies the push service a device token belongs to.
+type Platform string
+
+// Platforms supported by the clients.
+const (
+	PlatformAPNS Platform = "apns"
+	PlatformGCM  Platform = "gcm"
+	PlatformADM  Platform = "adm"
+	PlatformC2DM Platform = "c2dm"
+	PlatformFCM  Platform = "fcm"
+	// PlatformWebPush is the TokenStore namespace of the subscription
+	// endpoints WebPushClient removes. Sending needs the subscription's
+	// keys as well, so there is no Service or RouterApp field for it.
+	PlatformWebPush Platform = "webpush"
+)
+
+// Target is a notification for one device.
+type Target struct {
+	Platform     Platform      `json:"platform"`
+	Token        string        `json:"token"`
+	Notification *Notification `json:"notification"`
+}
+
+// Result is the outcome of sending to a Target. Response is nil if
+// the request couldn't be made.
+type Result struct {
+	Target   *Target
+	Response Response
+	Error    error
+}
+
+// Results are in the order of the targets sent.
+type Results []*Result
+
+// Failed returns the results with an error.
+func (r Results) Failed() Results {
+	ret := Results{}
+	for _, result := range r {
+		if result.Error != nil {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+// Retry returns the failed results the service asked to retry.
+func (r Results) Retry() Results {
+	ret := Results{}
+	for _, result := range r {
+		if result.Error != nil && result.Response != nil && result.Response.Retry() >= 0 {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+// UpdateToken returns the results whose token should be replaced
+// or removed.
+func (r Results) UpdateToken() Results {
+	ret := Results{}
+	for _, result := range r {
+		if result.Response != nil && result.Response.UpdateToken() {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+// RouterApp holds the clients of an app, any of them may be nil.
+type RouterApp struct {
+	APNS APNSSender
+	// APNSTopic is the bundle id, see APNSService.
+	APNSTopic string
+	GCM       *GCMClient
+	ADM       *ADMClient
+	C2DM      *C2DMClient
+	FCM       *FCMClient
+}
+
+// Router sends notifications to the service configured for the
+// app and platform of each target.
+type Router struct {
+	// Concurrency is the number of targets sent at once.
+	Concurrency int
+
+	mu   sync.RWMutex
+	apps map[string]map[Platform]Service
+}
+
+// NewRouter ...
+func NewRouter() *Router {
+	return &Router{
+		Concurrency: 20,
+		apps:        make(map[string]map[Platform]Service),
+	}
+}
+
+// Register sets the service used for the app and platform.
+func (r *Router) Register(app string, platform Platform, s Service) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.apps[app] == nil {
+		r.apps[app] = make(map[Platform]Service)
+	}
+	r.apps[app][platform] = s
+}
+
+// AddApp registers a service for each client of the app.
+func (r *Router) AddApp(app string, a *RouterApp) {
+	if a.APNS != nil {
+		r.Register(app, PlatformAPNS, &APNSService{Client: a.APNS, Topic: a.APNSTopic})
+	}
+	if a.GCM != nil {
+		r.Register(app, PlatformGCM, &GCMService{Client: a.GCM})
+	}
+	if a.ADM != nil {
+		r.Register(app, PlatformADM, &ADMService{Client: a.ADM})
+	}
+	if a.C2DM != nil {
+		r.Register(app, PlatformC2DM, &C2DMService{Client: a.C2DM})
+	}
+	if a.FCM != nil {
+		r.Register(app, PlatformFCM, &FCMService{Client: a.FCM})
+	}
+}
+
+// Service returns the service for the app and platform.
+func (r *Router) Service(app string, platform Platform) (Service, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.apps[app][platform]
+	if !ok {
+		return nil, fmt.Errorf("no %s service for app %s", platform, app)
+	}
+	return s, nil
+}
+
+// SendOne sends to a single target.
+func (r *Router) SendOne(app string, t *Target) *Result {
+	ret := &Result{Target: t}
+	s, err := r.Service(app, t.Platform)
+	if err != nil {
+		ret.Error = err
+		return ret
+	}
+	ret.Response, ret.Error = s.Send(t.Token, t.Notification)
+	return ret
+}
+
+// Send sends to every target concurrently and waits for the results.
+func (r *Router) Send(app string, targets ...*Target) Results {
+	ret := make(Results, len(targets))
+	concurrency := r.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t *Target) {
+			defer wg.Done()
+			ret[i] = r.SendOne(app, t)
+			<-sem
+		}(i, t)
+	}
+	wg.Wait()
+	return ret
+}
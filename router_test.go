@@ -0,0 +1,101 @@
+package hermes
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testService answers by token prefix: "retry", "remove", "fail" and
+// anything else succeeds.
+type testService struct{}
+
+// Send implements interface Service.
+func (s *testService) Send(token string, n *Notification) (Response, error) {
+	switch {
+	case strings.HasPrefix(token, "retry"):
+		return &GCMResponse{RetryAfter: 1, Error: ErrRetry}, ErrRetry
+	case strings.HasPrefix(token, "remove"):
+		return &GCMResponse{RetryAfter: -1, Error: ErrRemoveToken}, ErrRemoveToken
+	case strings.HasPrefix(token, "fail"):
+		return nil, fmt.Errorf("failed")
+	}
+	return &GCMResponse{RetryAfter: -1}, nil
+}
+
+func TestRouterSend(t *testing.T) {
+	r := NewRouter()
+	r.Register("app", PlatformGCM, &testService{})
+	r.Register("app", PlatformADM, &testService{})
+
+	n := &Notification{Body: "hello"}
+	targets := []*Target{
+		{PlatformGCM, "ok", n},
+		{PlatformADM, "retry", n},
+		{PlatformGCM, "remove", n},
+		{PlatformADM, "fail", n},
+		{PlatformAPNS, "ok", n},
+	}
+	results := r.Send("app", targets...)
+	if len(results) != len(targets) {
+		t.Fatalf("expected %d results got %d", len(targets), len(results))
+	}
+	for i, result := range results {
+		if result.Target != targets[i] {
+			t.Fatalf("result %d out of order", i)
+		}
+	}
+	if results[0].Error != nil {
+		t.Fatal(results[0].Error)
+	}
+	if len(results.Failed()) != 4 {
+		t.Fatalf("expected 4 failures got %d", len(results.Failed()))
+	}
+	retry := results.Retry()
+	if len(retry) != 1 || retry[0].Target.Token != "retry" {
+		t.Fatalf("unexpected retries %+v", retry)
+	}
+	update := results.UpdateToken()
+	if len(update) != 1 || update[0].Target.Token != "remove" {
+		t.Fatalf("unexpected token updates %+v", update)
+	}
+	// no apns service registered
+	if results[4].Error == nil || results[4].Response != nil {
+		t.Fatalf("expected missing service error got %+v", results[4])
+	}
+
+	results = r.Send("unknown", targets[0])
+	if results[0].Error == nil {
+		t.Fatal("expected error for unknown app")
+	}
+}
+
+func TestRouterAddApp(t *testing.T) {
+	gcmClient, _ := NewGCMClient(GCMServer.URL, "abc", "")
+	admClient, _ := NewADMClient(ADMServer.URL, "abc")
+
+	r := NewRouter()
+	r.AddApp("app", &RouterApp{GCM: gcmClient, ADM: admClient})
+	if _, err := r.Service("app", PlatformGCM); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Service("app", PlatformAPNS); err == nil {
+		t.Fatal("apns should not be registered")
+	}
+
+	n := &Notification{Title: "hello"}
+	results := r.Send("app",
+		&Target{PlatformGCM, "1", n},
+		&Target{PlatformADM, "amzn1.adm-registration.v1.123", n},
+	)
+	if failed := results.Failed(); len(failed) != 0 {
+		t.Fatalf("unexpected failure %v", failed[0].Error)
+	}
+
+	// A canonical adm id is reported like gcm's.
+	results = r.Send("app", &Target{PlatformADM, "old", n})
+	update := results.UpdateToken()
+	if len(update) != 1 || update[0].Response.(*ADMResponse).RegistrationID != "new" {
+		t.Fatalf("expected the adm token updated got %+v", results[0])
+	}
+}
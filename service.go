@@ -0,0 +1,105 @@
+package hermes
+
+// APNSSender is implemented by APNSClient and APNSHTTP2Client.
+type APNSSender interface {
+	Send(apn *APNSPushNotification) (*APNSResponse, error)
+}
+
+// APNSService implements Service for an apns client.
+type APNSService struct {
+	Client APNSSender
+	// Topic is the bundle id, required by the http/2 api with token
+	// authentication.
+	Topic string
+}
+
+// Send implements interface Service.
+func (s *APNSService) Send(token string, n *Notification) (Response, error) {
+	apn, err := n.APNS(token)
+	if err != nil {
+		return nil, err
+	}
+	apn.Topic = s.Topic
+
+	resp, err := s.Client.Send(apn)
+	if resp == nil {
+		return nil, err
+	}
+	return resp, err
+}
+
+// GCMService implements Service for GCMClient.
+type GCMService struct {
+	Client *GCMClient
+}
+
+// Send implements interface Service.
+func (s *GCMService) Send(token string, n *Notification) (Response, error) {
+	m, err := n.GCM(token)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Client.Send(m)
+	if resp == nil {
+		return nil, err
+	}
+	return resp, err
+}
+
+// ADMService implements Service for ADMClient.
+type ADMService struct {
+	Client *ADMClient
+}
+
+// Send implements interface Service.
+func (s *ADMService) Send(token string, n *Notification) (Response, error) {
+	m, err := n.ADM(token)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Client.Send(m)
+	if resp == nil {
+		return nil, err
+	}
+	return resp, err
+}
+
+// C2DMService implements Service for C2DMClient.
+type C2DMService struct {
+	Client *C2DMClient
+}
+
+// Send implements interface Service.
+func (s *C2DMService) Send(token string, n *Notification) (Response, error) {
+	m, err := n.C2DM(token)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Client.Send(m)
+	if resp == nil {
+		return nil, err
+	}
+	return resp, err
+}
+
+// FCMService implements Service for FCMClient.
+type FCMService struct {
+	Client *FCMClient
+}
+
+// Send implements interface Service.
+func (s *FCMService) Send(token string, n *Notification) (Response, error) {
+	m, err := n.FCM(token)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Client.Send(m)
+	if resp == nil {
+		return nil, err
+	}
+	return resp, err
+}
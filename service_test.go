@@ -0,0 +1,74 @@
+package hermes
+
+import "testing"
+
+var (
+	_ Service = &APNSService{}
+	_ Service = &GCMService{}
+	_ Service = &ADMService{}
+	_ Service = &C2DMService{}
+	_ Service = &FCMService{}
+
+	_ APNSSender = &APNSClient{}
+	_ APNSSender = &APNSHTTP2Client{}
+)
+
+func TestServices(t *testing.T) {
+	apnsClient, _ := NewAPNSHTTP2Client(APNSHTTP2Server.URL, APNSCertMock, APNSKeyMock)
+	apnsClient.http = APNSHTTP2Server.Client()
+	gcmClient, _ := NewGCMClient(GCMServer.URL, "abc", "")
+	admClient, _ := NewADMClient(ADMServer.URL, "abc")
+	c2dmClient, _ := NewC2DMClient(C2DMServer.URL, "abc")
+
+	services := map[string]Service{
+		"apns": &APNSService{Client: apnsClient},
+		"gcm":  &GCMService{Client: gcmClient},
+		"adm":  &ADMService{Client: admClient},
+		"c2dm": &C2DMService{Client: c2dmClient},
+	}
+	n := &Notification{
+		Title: "hello",
+		Body:  "world",
+		Data:  map[string]interface{}{"a": "b"},
+	}
+	for name, s := range services {
+		resp, err := s.Send("E70331D08A2DA3BD02415DB2CAA4D7EEEC77FA2E5513B16F4F9E79C0BF89AED4", n)
+		if err != nil {
+			t.Fatalf("%s %s", name, err)
+		}
+		if resp == nil {
+			t.Fatalf("%s no response", name)
+		}
+		if resp.UpdateToken() {
+			t.Fatalf("%s unexpected token update %+v", name, resp)
+		}
+	}
+}
+
+func TestServiceRemoveToken(t *testing.T) {
+	apnsClient, _ := NewAPNSHTTP2Client(APNSHTTP2Server.URL, APNSCertMock, APNSKeyMock)
+	apnsClient.http = APNSHTTP2Server.Client()
+	gcmClient, _ := NewGCMClient(GCMServerRemoveToken.URL, "abc", "")
+	services := map[string]Service{
+		"apns": &APNSService{Client: apnsClient},
+		"gcm":  &GCMService{Client: gcmClient},
+	}
+	for name, s := range services {
+		resp, err := s.Send("dead", &Notification{Body: "hello"})
+		if err != ErrRemoveToken {
+			t.Fatalf("%s expected remove token got %v", name, err)
+		}
+		if !resp.UpdateToken() {
+			t.Fatalf("%s should update token", name)
+		}
+	}
+}
+
+func TestADMServiceData(t *testing.T) {
+	admClient, _ := NewADMClient(ADMServer.URL, "abc")
+	s := &ADMService{Client: admClient}
+	resp, err := s.Send("amzn1.adm-registration.v1.123", &Notification{Data: map[string]interface{}{"a": 1}})
+	if err == nil || resp != nil {
+		t.Fatal("expected error for non string data")
+	}
+}
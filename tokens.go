@@ -0,0 +1,221 @@
+package hermes
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// TokenStore keeps device tokens up to date with the changes the
+// services report. Clients with a store set call it after each send,
+// replacing tokens the service returned a canonical id for and removing
+// the ones no longer registered.
+type TokenStore interface {
+	// Replace swaps old for the canonical token new, tokens replaced
+	// by old before now point to new as well.
+	Replace(platform Platform, old, new string) error
+	// Remove deletes the token and any replaced by it.
+	Remove(platform Platform, token string) error
+	// Lookup returns the token to send to for token, false if it
+	// isn't known or was removed.
+	Lookup(platform Platform, token string) (string, bool, error)
+}
+
+// TokenStoreError is the error of a send whose token change could not
+// be stored. Err is the store's error, the caller has to update the
+// token itself.
+type TokenStoreError struct {
+	Op       string
+	Platform Platform
+	Token    string
+	Err      error
+}
+
+func (e *TokenStoreError) Error() string {
+	return fmt.Sprintf("token store %s %s %s: %v", e.Op, e.Platform, e.Token, e.Err)
+}
+
+// isTokenError reports whether err asks to update or remove the token.
+func isTokenError(err error) bool {
+	if _, ok := err.(*TokenStoreError); ok {
+		return true
+	}
+	return err == ErrRemoveToken || err == ErrUpdateToken
+}
+
+// tokenChange replaces old with new, or removes old if new is empty.
+type tokenChange struct {
+	old string
+	new string
+}
+
+// storeTokens applies the changes to s, stopping at the first error.
+func storeTokens(s TokenStore, platform Platform, changes ...tokenChange) error {
+	if s == nil {
+		return nil
+	}
+	for _, c := range changes {
+		if c.new == "" {
+			err := s.Remove(platform, c.old)
+			if err != nil {
+				return &TokenStoreError{Op: "remove", Platform: platform, Token: c.old, Err: err}
+			}
+			continue
+		}
+		if c.new == c.old {
+			continue
+		}
+		err := s.Replace(platform, c.old, c.new)
+		if err != nil {
+			return &TokenStoreError{Op: "replace", Platform: platform, Token: c.old, Err: err}
+		}
+	}
+	return nil
+}
+
+// MemoryTokenStore keeps the tokens in a map, for tests and single
+// processes.
+type MemoryTokenStore struct {
+	mu     sync.RWMutex
+	tokens map[Platform]map[string]string // token to the one to send to
+}
+
+// NewMemoryTokenStore ...
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[Platform]map[string]string)}
+}
+
+// Add registers a token.
+func (s *MemoryTokenStore) Add(platform Platform, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.platform(platform)[token] = token
+	return nil
+}
+
+// platform must be called with mu held.
+func (s *MemoryTokenStore) platform(platform Platform) map[string]string {
+	tokens, ok := s.tokens[platform]
+	if !ok {
+		tokens = make(map[string]string)
+		s.tokens[platform] = tokens
+	}
+	return tokens
+}
+
+// Replace implements interface TokenStore.
+func (s *MemoryTokenStore) Replace(platform Platform, old, new string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := s.platform(platform)
+	for token, current := range tokens {
+		if current == old {
+			tokens[token] = new
+		}
+	}
+	tokens[old] = new
+	tokens[new] = new
+	return nil
+}
+
+// Remove implements interface TokenStore.
+func (s *MemoryTokenStore) Remove(platform Platform, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := s.platform(platform)
+	for t, current := range tokens {
+		if t == token || current == token {
+			delete(tokens, t)
+		}
+	}
+	return nil
+}
+
+// Lookup implements interface TokenStore.
+func (s *MemoryTokenStore) Lookup(platform Platform, token string) (string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	current, ok := s.tokens[platform][token]
+	return current, ok, nil
+}
+
+// SQLTokenStore keeps the tokens in a table of
+//
+//	platform, token, canonical
+//
+// where canonical is the token to send to. Queries use ? placeholders
+// as sqlite and mysql do.
+type SQLTokenStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLTokenStore returns a store using table, see CreateTable.
+func NewSQLTokenStore(db *sql.DB, table string) *SQLTokenStore {
+	return &SQLTokenStore{db: db, table: table}
+}
+
+// CreateTable creates the table if it doesn't exist.
+func (s *SQLTokenStore) CreateTable() error {
+	_, err := s.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	platform VARCHAR(16) NOT NULL,
+	token TEXT NOT NULL,
+	canonical TEXT NOT NULL,
+	PRIMARY KEY (platform, token)
+)`, s.table))
+	return err
+}
+
+// Add registers a token, keeping it as is if it exists.
+func (s *SQLTokenStore) Add(platform Platform, token string) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		`INSERT INTO %s (platform, token, canonical) SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM %s WHERE platform = ? AND token = ?)`,
+		s.table, s.table), platform, token, token, platform, token)
+	return err
+}
+
+// Replace implements interface TokenStore.
+func (s *SQLTokenStore) Replace(platform Platform, old, new string) error {
+	if old == new {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE %s SET canonical = ? WHERE platform = ? AND canonical = ?`, []interface{}{new, platform, old}},
+		{`DELETE FROM %s WHERE platform = ? AND token IN (?, ?)`, []interface{}{platform, old, new}},
+		{`INSERT INTO %s (platform, token, canonical) VALUES (?, ?, ?), (?, ?, ?)`, []interface{}{platform, old, new, platform, new, new}},
+	}
+	for _, q := range queries {
+		_, err = tx.Exec(fmt.Sprintf(q.query, s.table), q.args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Remove implements interface TokenStore.
+func (s *SQLTokenStore) Remove(platform Platform, token string) error {
+	_, err := s.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE platform = ? AND (token = ? OR canonical = ?)`, s.table), platform, token, token)
+	return err
+}
+
+// Lookup implements interface TokenStore.
+func (s *SQLTokenStore) Lookup(platform Platform, token string) (string, bool, error) {
+	var canonical string
+	err := s.db.QueryRow(fmt.Sprintf(`SELECT canonical FROM %s WHERE platform = ? AND token = ?`, s.table), platform, token).Scan(&canonical)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return canonical, true, nil
+}
@@ -0,0 +1,36 @@
+//go:build sqlite
+
+// The sql store runs against sqlite with go test -tags sqlite, it needs
+// github.com/mattn/go-sqlite3 and cgo. TestSQLTokenStoreQueries checks
+// its statements against a fake driver without it.
+
+package hermes
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLTokenStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Every connection has its own in memory database.
+	db.SetMaxOpenConns(1)
+
+	s := NewSQLTokenStore(db, "hermes_tokens")
+	err = s.CreateTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Creating it again is fine.
+	err = s.CreateTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTokenStore(t, s, s.Add)
+}
@@ -0,0 +1,402 @@
+package hermes
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testTokenStore runs the TokenStore behaviour shared by the stores,
+// add registers a token.
+func testTokenStore(t *testing.T, s TokenStore, add func(Platform, string) error) {
+	for _, token := range []string{"a", "b", "x"} {
+		if err := add(PlatformGCM, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(PlatformGCM, "a")
+	add(PlatformAPNS, "a")
+
+	lookup := func(platform Platform, token string) (string, bool) {
+		current, ok, err := s.Lookup(platform, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return current, ok
+	}
+	if current, ok := lookup(PlatformGCM, "a"); !ok || current != "a" {
+		t.Fatalf("expected a got %q %v", current, ok)
+	}
+	if _, ok := lookup(PlatformGCM, "unknown"); ok {
+		t.Fatal("unknown token found")
+	}
+
+	// a -> b -> c, both old tokens send to c.
+	if err := s.Replace(PlatformGCM, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Replace(PlatformGCM, "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Replace(PlatformGCM, "c", "c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"a", "b", "c"} {
+		if current, ok := lookup(PlatformGCM, token); !ok || current != "c" {
+			t.Fatalf("expected %s replaced by c got %q %v", token, current, ok)
+		}
+	}
+	if current, _ := lookup(PlatformAPNS, "a"); current != "a" {
+		t.Fatalf("other platforms changed %q", current)
+	}
+
+	if err := s.Remove(PlatformGCM, "c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"a", "b", "c"} {
+		if _, ok := lookup(PlatformGCM, token); ok {
+			t.Fatalf("expected %s removed", token)
+		}
+	}
+	if _, ok := lookup(PlatformGCM, "x"); !ok {
+		t.Fatal("x removed")
+	}
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	s := NewMemoryTokenStore()
+	testTokenStore(t, s, s.Add)
+}
+
+// fakeSQLDriver keeps a single token table in memory. It only knows the
+// statements of SQLTokenStore, checking the table they name and that
+// the arguments match their placeholders.
+type fakeSQLDriver struct {
+	table string
+
+	mu      sync.Mutex
+	created bool
+	rows    []fakeSQLRow
+}
+
+type fakeSQLRow struct {
+	platform, token, canonical string
+}
+
+var fakeSQL = &fakeSQLDriver{table: "hermes_tokens"}
+
+func init() {
+	sql.Register("hermes-fake", fakeSQL)
+}
+
+// fakeSQLStatements are the statements understood, each returns the
+// canonical tokens selected.
+var fakeSQLStatements = []struct {
+	re   *regexp.Regexp
+	exec func(d *fakeSQLDriver, a []string) ([]string, error)
+}{
+	{regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \(`), func(d *fakeSQLDriver, a []string) ([]string, error) {
+		d.created = true
+		return nil, nil
+	}},
+	{regexp.MustCompile(`^INSERT INTO (\w+) \(platform, token, canonical\) SELECT \?, \?, \? WHERE NOT EXISTS \(SELECT 1 FROM (\w+) WHERE platform = \? AND token = \?\)$`), func(d *fakeSQLDriver, a []string) ([]string, error) {
+		if d.find(a[3], a[4]) < 0 {
+			d.rows = append(d.rows, fakeSQLRow{a[0], a[1], a[2]})
+		}
+		return nil, nil
+	}},
+	{regexp.MustCompile(`^UPDATE (\w+) SET canonical = \? WHERE platform = \? AND canonical = \?$`), func(d *fakeSQLDriver, a []string) ([]string, error) {
+		for i, r := range d.rows {
+			if r.platform == a[1] && r.canonical == a[2] {
+				d.rows[i].canonical = a[0]
+			}
+		}
+		return nil, nil
+	}},
+	{regexp.MustCompile(`^DELETE FROM (\w+) WHERE platform = \? AND token IN \(\?, \?\)$`), func(d *fakeSQLDriver, a []string) ([]string, error) {
+		d.remove(func(r fakeSQLRow) bool { return r.platform == a[0] && (r.token == a[1] || r.token == a[2]) })
+		return nil, nil
+	}},
+	{regexp.MustCompile(`^INSERT INTO (\w+) \(platform, token, canonical\) VALUES \(\?, \?, \?\), \(\?, \?, \?\)$`), func(d *fakeSQLDriver, a []string) ([]string, error) {
+		for i := 0; i < len(a); i += 3 {
+			if d.find(a[i], a[i+1]) >= 0 {
+				return nil, fmt.Errorf("duplicate key %s %s", a[i], a[i+1])
+			}
+			d.rows = append(d.rows, fakeSQLRow{a[i], a[i+1], a[i+2]})
+		}
+		return nil, nil
+	}},
+	{regexp.MustCompile(`^DELETE FROM (\w+) WHERE platform = \? AND \(token = \? OR canonical = \?\)$`), func(d *fakeSQLDriver, a []string) ([]string, error) {
+		d.remove(func(r fakeSQLRow) bool { return r.platform == a[0] && (r.token == a[1] || r.canonical == a[2]) })
+		return nil, nil
+	}},
+	{regexp.MustCompile(`^SELECT canonical FROM (\w+) WHERE platform = \? AND token = \?$`), func(d *fakeSQLDriver, a []string) ([]string, error) {
+		if i := d.find(a[0], a[1]); i >= 0 {
+			return []string{d.rows[i].canonical}, nil
+		}
+		return nil, nil
+	}},
+}
+
+func (d *fakeSQLDriver) find(platform, token string) int {
+	for i, r := range d.rows {
+		if r.platform == platform && r.token == token {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *fakeSQLDriver) remove(match func(fakeSQLRow) bool) {
+	kept := []fakeSQLRow{}
+	for _, r := range d.rows {
+		if !match(r) {
+			kept = append(kept, r)
+		}
+	}
+	d.rows = kept
+}
+
+// Open implements interface driver.Driver.
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return &fakeSQLConn{d}, nil
+}
+
+type fakeSQLConn struct {
+	d *fakeSQLDriver
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	query = strings.Join(strings.Fields(query), " ")
+	for _, s := range fakeSQLStatements {
+		m := s.re.FindStringSubmatch(query)
+		if m == nil {
+			continue
+		}
+		c.d.mu.Lock()
+		created := c.d.created
+		c.d.mu.Unlock()
+		for _, table := range m[1:] {
+			if table != c.d.table || !created && !strings.HasPrefix(query, "CREATE") {
+				return nil, fmt.Errorf("no such table %s", table)
+			}
+		}
+		return &fakeSQLStmt{c.d, strings.Count(query, "?"), s.exec}, nil
+	}
+	return nil, fmt.Errorf("unexpected statement %s", query)
+}
+
+func (c *fakeSQLConn) Close() error {
+	return nil
+}
+
+// Begin snapshots the rows to restore on Rollback.
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	return &fakeSQLTx{c.d, append([]fakeSQLRow{}, c.d.rows...)}, nil
+}
+
+type fakeSQLTx struct {
+	d    *fakeSQLDriver
+	rows []fakeSQLRow
+}
+
+func (tx *fakeSQLTx) Commit() error {
+	return nil
+}
+
+func (tx *fakeSQLTx) Rollback() error {
+	tx.d.mu.Lock()
+	tx.d.rows = tx.rows
+	tx.d.mu.Unlock()
+	return nil
+}
+
+type fakeSQLStmt struct {
+	d     *fakeSQLDriver
+	n     int
+	apply func(d *fakeSQLDriver, a []string) ([]string, error)
+}
+
+func (s *fakeSQLStmt) Close() error {
+	return nil
+}
+
+// NumInput makes database/sql check the arguments match the
+// placeholders.
+func (s *fakeSQLStmt) NumInput() int {
+	return s.n
+}
+
+func (s *fakeSQLStmt) run(args []driver.Value) ([]string, error) {
+	a := make([]string, len(args))
+	for i, arg := range args {
+		v, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("argument %d is %T not a string", i, arg)
+		}
+		a[i] = v
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	return s.apply(s.d, a)
+}
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, err := s.run(args)
+	return driver.RowsAffected(0), err
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	values, err := s.run(args)
+	return &fakeSQLRows{values}, err
+}
+
+type fakeSQLRows struct {
+	values []string
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{"canonical"}
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+// TestSQLTokenStoreQueries runs the store against fakeSQLDriver, see
+// TestSQLTokenStore for a real database.
+func TestSQLTokenStoreQueries(t *testing.T) {
+	db, err := sql.Open("hermes-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := NewSQLTokenStore(db, "hermes_tokens")
+	if _, _, err = s.Lookup(PlatformGCM, "a"); err == nil {
+		t.Fatal("expected error before the table is created")
+	}
+	if err = s.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	testTokenStore(t, s, s.Add)
+
+	if _, _, err = NewSQLTokenStore(db, "other").Lookup(PlatformGCM, "x"); err == nil {
+		t.Fatal("expected error for another table")
+	}
+}
+
+// failingTokenStore fails every change.
+type failingTokenStore struct{}
+
+func (failingTokenStore) Replace(platform Platform, old, new string) error {
+	return fmt.Errorf("replace failed")
+}
+
+func (failingTokenStore) Remove(platform Platform, token string) error {
+	return fmt.Errorf("remove failed")
+}
+
+func (failingTokenStore) Lookup(platform Platform, token string) (string, bool, error) {
+	return "", false, fmt.Errorf("lookup failed")
+}
+
+func TestGCMTokenStore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"success":2,"failure":2,"canonical_ids":1,"results":[
+			{"message_id":"1"},
+			{"message_id":"2","registration_id":"new"},
+			{"error":"NotRegistered"},
+			{"error":"Unavailable"}
+		]}`)
+	}))
+	defer srv.Close()
+
+	s := NewMemoryTokenStore()
+	for _, token := range []string{"ok", "old", "gone", "busy"} {
+		s.Add(PlatformGCM, token)
+	}
+	c, _ := NewGCMClient(srv.URL, "abc", "")
+	c.Tokens = s
+	m := NewGCMMessage("ok", "old", "gone", "busy")
+	m.SetPayload("a", "b")
+	_, err := c.Send(m)
+	if err != ErrRetry {
+		t.Fatalf("expected retry got %v", err)
+	}
+
+	want := map[string]string{"ok": "ok", "old": "new", "new": "new", "busy": "busy"}
+	for token, current := range want {
+		if got, _, _ := s.Lookup(PlatformGCM, token); got != current {
+			t.Fatalf("expected %s for %s got %q", current, token, got)
+		}
+	}
+	if _, ok, _ := s.Lookup(PlatformGCM, "gone"); ok {
+		t.Fatal("expected gone removed")
+	}
+
+	c.Tokens = failingTokenStore{}
+	resp, err := c.Send(m)
+	serr, ok := err.(*TokenStoreError)
+	if !ok || serr.Op != "replace" || serr.Token != "old" {
+		t.Fatalf("expected store error got %v", err)
+	}
+	if !resp.UpdateToken() {
+		t.Fatal("expected the caller to update the token")
+	}
+}
+
+func TestADMTokenStore(t *testing.T) {
+	s := NewMemoryTokenStore()
+	c, _ := NewADMClient(ADMServer.URL, "abc")
+	c.Tokens = s
+	s.Add(PlatformADM, "old")
+	m := NewADMMessage("old")
+	m.Data["a"] = "b"
+	resp, err := c.Send(m)
+	if err != ErrUpdateToken || !resp.UpdateToken() {
+		t.Fatalf("expected update token got %v", err)
+	}
+	if got, _, _ := s.Lookup(PlatformADM, m.RegistrationID); got != "new" || resp.RegistrationID != "new" {
+		t.Fatalf("expected canonical id got %q", got)
+	}
+}
+
+func TestAPNSHTTP2TokenStore(t *testing.T) {
+	c, _ := NewAPNSHTTP2Client(APNSHTTP2Server.URL, APNSCertMock, APNSKeyMock)
+	c.http = APNSHTTP2Server.Client()
+	s := NewMemoryTokenStore()
+	c.Tokens = s
+
+	tokens := []string{"bad0aa", "dead", "abcd"}
+	for _, token := range tokens {
+		s.Add(PlatformAPNS, token)
+	}
+	for _, token := range tokens {
+		apn, _ := NewAPNSPushNotification(token, &APNSMessage{Alert: "hello"}, 10)
+		c.Send(apn)
+	}
+	for i, token := range tokens {
+		_, ok, _ := s.Lookup(PlatformAPNS, token)
+		if ok != (i == 2) {
+			t.Fatalf("unexpected %s found %v", token, ok)
+		}
+	}
+}
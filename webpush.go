@@ -0,0 +1,396 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebPushMaxPayload is the largest payload that fits in the 4096 bytes
+// push services accept once encrypted.
+const WebPushMaxPayload = 4096 - webPushHeaderSize - 1 - 16
+
+// Urgencies of WebPushMessage, RFC 8030 5.3.
+const (
+	WebPushUrgencyVeryLow = "very-low"
+	WebPushUrgencyLow     = "low"
+	WebPushUrgencyNormal  = "normal"
+	WebPushUrgencyHigh    = "high"
+)
+
+// WebPushVAPIDLifetime is how long a VAPID token is reused, push
+// services reject tokens expiring more than 24 hours ahead.
+var WebPushVAPIDLifetime = 12 * time.Hour
+
+const (
+	// webPushHeaderSize is salt, record size, key id length and the
+	// 65 byte key id of an aes128gcm header.
+	webPushHeaderSize = 16 + 4 + 1 + 65
+	webPushRecordSize = 4096
+)
+
+// webPushTopic is what a Topic may contain, RFC 8030 5.4.
+var webPushTopic = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// WebPushSubscription is the PushSubscription of a browser as returned
+// by its toJSON.
+type WebPushSubscription struct {
+	Endpoint string      `json:"endpoint"`
+	Keys     WebPushKeys `json:"keys"`
+}
+
+// WebPushKeys are the base64url encoded keys of a subscription.
+type WebPushKeys struct {
+	// P256DH is the user agent's public key.
+	P256DH string `json:"p256dh"`
+	// Auth is the authentication secret.
+	Auth string `json:"auth"`
+}
+
+// WebPushMessage is a payload to push to a subscription.
+type WebPushMessage struct {
+	Subscription *WebPushSubscription
+	// Payload is encrypted for the subscription, none is sent if empty.
+	Payload []byte
+	// TTL is how many seconds the push service keeps the message, 0
+	// delivers it only if the browser is reachable now.
+	TTL int
+	// Urgency is one of the WebPushUrgency constants, normal if empty.
+	Urgency string
+	// Topic replaces a pending message with the same topic, at most 32
+	// url safe base64 characters.
+	Topic string
+}
+
+// Bytes implements interface Message.
+func (m *WebPushMessage) Bytes() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Validate checks the subscription and headers.
+func (m *WebPushMessage) Validate() error {
+	if m.Subscription == nil || m.Subscription.Endpoint == "" {
+		return fmt.Errorf("no subscription endpoint")
+	}
+	if len(m.Payload) > WebPushMaxPayload {
+		return fmt.Errorf("payload of %d bytes, at most %d allowed", len(m.Payload), WebPushMaxPayload)
+	}
+	if m.TTL < 0 {
+		return fmt.Errorf("negative ttl %d", m.TTL)
+	}
+	switch m.Urgency {
+	case "", WebPushUrgencyVeryLow, WebPushUrgencyLow, WebPushUrgencyNormal, WebPushUrgencyHigh:
+	default:
+		return fmt.Errorf("unknown urgency %q", m.Urgency)
+	}
+	if m.Topic != "" && !webPushTopic.MatchString(m.Topic) {
+		return fmt.Errorf("invalid topic %q", m.Topic)
+	}
+	return nil
+}
+
+// WebPushResponse is the push service's response.
+type WebPushResponse struct {
+	StatusCode int `json:"status_code"`
+	// Location is the url of the message created.
+	Location string `json:"location"`
+	// set to -1 initially, if >= 0 then retry.
+	RetryAfter   int   `json:"retry_after"`
+	Error        error `json:"error"`
+	ResponseTime int64 `json:"response_time"` // time in milliseconds
+}
+
+// Bytes implements interface Response.
+func (r *WebPushResponse) Bytes() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Retry implements interface Response.
+func (r *WebPushResponse) Retry() int {
+	return r.RetryAfter
+}
+
+// UpdateToken implements interface Response, true when the
+// subscription expired or was unsubscribed.
+func (r *WebPushResponse) UpdateToken() bool {
+	if r == nil {
+		return false
+	}
+	return isTokenError(r.Error)
+}
+
+// WebPushVAPID signs the VAPID tokens (JWT ES256) identifying the
+// application server to push services, RFC 8292. Tokens are reused per
+// push service until they are about to expire.
+type WebPushVAPID struct {
+	// Subject is a mailto: or https: contact for the push services.
+	Subject string
+	// PublicKey is the base64url encoded key browsers subscribe with
+	// as applicationServerKey.
+	PublicKey string
+	key       *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	tokens map[string]*webPushVAPIDToken
+}
+
+type webPushVAPIDToken struct {
+	jwt     string
+	expires time.Time
+}
+
+// NewWebPushVAPID parses the PEM encoded P-256 key, as generated by
+// openssl ecparam -name prime256v1 -genkey -noout.
+func NewWebPushVAPID(subject string, key []byte) (*WebPushVAPID, error) {
+	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https:") {
+		return nil, fmt.Errorf("subject must be a mailto: or https: url")
+	}
+	k, err := parseECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if k.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("key must use the P-256 curve")
+	}
+	pub, err := k.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return &WebPushVAPID{
+		Subject:   subject,
+		PublicKey: base64.RawURLEncoding.EncodeToString(pub.Bytes()),
+		key:       k,
+		tokens:    make(map[string]*webPushVAPIDToken),
+	}, nil
+}
+
+// Authorization returns the Authorization header for the endpoint.
+func (v *WebPushVAPID) Authorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	audience := u.Scheme + "://" + u.Host
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	t := v.tokens[audience]
+	if t == nil || !now.Add(WebPushVAPIDLifetime/2).Before(t.expires) {
+		expires := now.Add(WebPushVAPIDLifetime)
+		header := map[string]string{"typ": "JWT", "alg": "ES256"}
+		claims := map[string]interface{}{
+			"aud": audience,
+			"exp": expires.Unix(),
+			"sub": v.Subject,
+		}
+		jwt, err := encodeJWT(header, claims, es256Signer(v.key))
+		if err != nil {
+			return "", err
+		}
+		t = &webPushVAPIDToken{jwt: jwt, expires: expires}
+		v.tokens[audience] = t
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", t.jwt, v.PublicKey), nil
+}
+
+// WebPushClient pushes messages to browsers through the push service of
+// each subscription's endpoint.
+type WebPushClient struct {
+	VAPID *WebPushVAPID
+	// RetryPolicy sets the backoff when the service gives no
+	// Retry-After, nil uses DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+	// Tokens removes the endpoints of expired subscriptions if set.
+	Tokens TokenStore
+	http   *http.Client
+}
+
+// NewWebPushClient ...
+func NewWebPushClient(vapid *WebPushVAPID) (*WebPushClient, error) {
+	if vapid == nil {
+		return nil, fmt.Errorf("vapid not provided")
+	}
+	return &WebPushClient{
+		VAPID: vapid,
+		http:  &http.Client{Timeout: 20 * time.Second},
+	}, nil
+}
+
+// Send encrypts the payload for the subscription and posts it to its
+// endpoint.
+func (c *WebPushClient) Send(m *WebPushMessage) (*WebPushResponse, error) {
+	err := m.Validate()
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if len(m.Payload) > 0 {
+		body, err = webPushEncrypt(m.Payload, &m.Subscription.Keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	auth, err := c.VAPID.Authorization(m.Subscription.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("POST", m.Subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", auth)
+	request.Header.Set("TTL", fmt.Sprintf("%d", m.TTL))
+	if len(body) > 0 {
+		request.Header.Set("Content-Encoding", "aes128gcm")
+		request.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if m.Urgency != "" {
+		request.Header.Set("Urgency", m.Urgency)
+	}
+	if m.Topic != "" {
+		request.Header.Set("Topic", m.Topic)
+	}
+
+	start := time.Now()
+	resp, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &WebPushResponse{
+		StatusCode:   resp.StatusCode,
+		Location:     resp.Header.Get("Location"),
+		RetryAfter:   -1,
+		ResponseTime: time.Since(start).Nanoseconds() / 1000000,
+	}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+	case resp.StatusCode == 404, resp.StatusCode == 410:
+		// The subscription expired or was unsubscribed.
+		ret.Error = ErrRemoveToken
+		err = storeTokens(c.Tokens, PlatformWebPush, tokenChange{old: m.Subscription.Endpoint})
+		if err != nil {
+			ret.Error = err
+		}
+	case resp.StatusCode == 429, resp.StatusCode >= 500:
+		ret.RetryAfter = c.RetryPolicy.RetryAfter(resp.Header)
+		ret.Error = ErrRetry
+	default:
+		// 400 invalid request, 401 or 403 vapid rejected, 413 payload
+		// too large.
+		ret.Error = fmt.Errorf("webpush %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return ret, ret.Error
+}
+
+// webPushEncrypt encrypts the payload for the subscription's keys as a
+// single aes128gcm record with a new key and salt, RFC 8291.
+func webPushEncrypt(payload []byte, keys *WebPushKeys) ([]byte, error) {
+	server, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return webPushSeal(payload, keys, server, salt)
+}
+
+// webPushSeal encrypts the payload with the server key and salt.
+func webPushSeal(payload []byte, keys *WebPushKeys, server *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	uaPublic, err := webPushDecodeKey(keys.P256DH)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %s", err)
+	}
+	authSecret, err := webPushDecodeKey(keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %s", err)
+	}
+	if len(authSecret) != 16 {
+		return nil, fmt.Errorf("auth secret of %d bytes, expected 16", len(authSecret))
+	}
+	ua, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %s", err)
+	}
+	secret, err := server.ECDH(ua)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := server.PublicKey().Bytes()
+	gcm, nonce, err := webPushCipher(secret, authSecret, salt, uaPublic, asPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, webPushHeaderSize)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	// 2 delimits the last record, no padding.
+	record := append(append([]byte{}, payload...), 2)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// webPushCipher derives the content encryption key and nonce from the
+// shared secret.
+func webPushCipher(secret, authSecret, salt, uaPublic, asPublic []byte) (cipher.AEAD, []byte, error) {
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := webPushHKDF(authSecret, secret, keyInfo, 32)
+	cek := webPushHKDF(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := webPushHKDF(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, nonce, nil
+}
+
+// webPushHKDF is HKDF-SHA-256 of at most 32 bytes, RFC 5869.
+func webPushHKDF(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+// webPushDecodeKey decodes base64url keys, padded or not.
+func webPushDecodeKey(key string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+}
@@ -0,0 +1,393 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func webPushDecode(t *testing.T, s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// webPushDecrypt opens an aes128gcm body with the user agent's key.
+func webPushDecrypt(body []byte, ua *ecdh.PrivateKey, authSecret []byte) ([]byte, error) {
+	if len(body) < webPushHeaderSize {
+		return nil, fmt.Errorf("short body")
+	}
+	salt, keyID := body[:16], body[21:webPushHeaderSize]
+	if binary.BigEndian.Uint32(body[16:20]) < 18 || body[20] != 65 {
+		return nil, fmt.Errorf("invalid header")
+	}
+	as, err := ecdh.P256().NewPublicKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ua.ECDH(as)
+	if err != nil {
+		return nil, err
+	}
+	gcm, nonce, err := webPushCipher(secret, authSecret, salt, ua.PublicKey().Bytes(), keyID)
+	if err != nil {
+		return nil, err
+	}
+	record, err := gcm.Open(nil, nonce, body[webPushHeaderSize:], nil)
+	if err != nil {
+		return nil, err
+	}
+	record = bytes.TrimRight(record, "\x00")
+	if len(record) == 0 || record[len(record)-1] != 2 {
+		return nil, fmt.Errorf("no last record delimiter")
+	}
+	return record[:len(record)-1], nil
+}
+
+func TestWebPushEncrypt(t *testing.T) {
+	// RFC 8291 appendix A.
+	as, err := ecdh.P256().NewPrivateKey(webPushDecode(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ua, err := ecdh.P256().NewPrivateKey(webPushDecode(t, "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &WebPushKeys{
+		P256DH: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+		Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+	}
+	plaintext := []byte("When I grow up, I want to be a watermelon")
+	body, err := webPushSeal(plaintext, keys, as, webPushDecode(t, "DGv6ra1nlYgDCS1FRnbzlw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if encoded := base64.RawURLEncoding.EncodeToString(body); encoded != expected {
+		t.Fatalf("expected %s got %s", expected, encoded)
+	}
+
+	// Every payload gets a new key and salt.
+	body, err = webPushEncrypt(plaintext, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := webPushDecrypt(body, ua, webPushDecode(t, keys.Auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(plaintext) {
+		t.Fatalf("expected %q got %q", plaintext, out)
+	}
+	again, _ := webPushEncrypt(plaintext, keys)
+	if bytes.Equal(body[:webPushHeaderSize], again[:webPushHeaderSize]) {
+		t.Fatal("expected a new salt and key")
+	}
+
+	if _, err := webPushEncrypt(plaintext, &WebPushKeys{P256DH: keys.P256DH, Auth: "short"}); err == nil {
+		t.Fatal("expected error for auth secret")
+	}
+	if _, err := webPushEncrypt(plaintext, &WebPushKeys{P256DH: "BCVxsr7N", Auth: keys.Auth}); err == nil {
+		t.Fatal("expected error for p256dh")
+	}
+}
+
+func TestNewWebPushVAPID(t *testing.T) {
+	if _, err := NewWebPushVAPID("push@example.com", WebPushVAPIDP8); err == nil {
+		t.Fatal("expected error for subject")
+	}
+	if _, err := NewWebPushVAPID("mailto:push@example.com", []byte("key")); err == nil {
+		t.Fatal("expected error for key")
+	}
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(p384)
+	if _, err := NewWebPushVAPID("mailto:push@example.com", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err == nil {
+		t.Fatal("expected error for curve")
+	}
+	if _, err := NewWebPushClient(nil); err == nil {
+		t.Fatal("expected error without vapid")
+	}
+
+	v, err := NewWebPushVAPID("mailto:push@example.com", WebPushVAPIDP8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ := WebPushServer.vapid.ECDH()
+	if v.PublicKey != base64.RawURLEncoding.EncodeToString(k.Bytes()) {
+		t.Fatalf("unexpected public key %s", v.PublicKey)
+	}
+	a, err := v.Authorization("https://push.example.com/send/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := v.Authorization("https://push.example.com/send/2")
+	if a != b {
+		t.Fatal("expected the token reused for the origin")
+	}
+	c, _ := v.Authorization("https://other.example.com/send/1")
+	if a == c {
+		t.Fatal("expected a token per origin")
+	}
+	if _, err := v.Authorization("/send/1"); err == nil {
+		t.Fatal("expected error for endpoint")
+	}
+}
+
+func TestWebPushMessageValidate(t *testing.T) {
+	sub := &WebPushSubscription{Endpoint: "https://push.example.com/send/1"}
+	tests := []struct {
+		m     *WebPushMessage
+		valid bool
+	}{
+		{&WebPushMessage{Subscription: sub}, true},
+		{&WebPushMessage{Subscription: sub, Payload: make([]byte, WebPushMaxPayload)}, true},
+		{&WebPushMessage{Subscription: sub, Urgency: WebPushUrgencyHigh, Topic: "news-1_a"}, true},
+		{&WebPushMessage{}, false},
+		{&WebPushMessage{Subscription: &WebPushSubscription{}}, false},
+		{&WebPushMessage{Subscription: sub, Payload: make([]byte, WebPushMaxPayload+1)}, false},
+		{&WebPushMessage{Subscription: sub, TTL: -1}, false},
+		{&WebPushMessage{Subscription: sub, Urgency: "urgent"}, false},
+		{&WebPushMessage{Subscription: sub, Topic: "news/1"}, false},
+		{&WebPushMessage{Subscription: sub, Topic: strings.Repeat("a", 33)}, false},
+	}
+	for i, test := range tests {
+		if err := test.m.Validate(); (err == nil) != test.valid {
+			t.Errorf("%d: expected valid %v got %v", i, test.valid, err)
+		}
+	}
+}
+
+// webPushServer is a push service that checks the vapid token and
+// decrypts what it receives. Endpoints under /gone/ and /missing/ are
+// unsubscribed, under /busy/ it is rate limited.
+type webPushServer struct {
+	*httptest.Server
+	vapid *ecdsa.PublicKey
+	ua    *ecdh.PrivateKey
+	auth  []byte
+
+	mu       sync.Mutex
+	payloads [][]byte
+	headers  []http.Header
+}
+
+var (
+	// WebPushServer accepts vapid tokens signed with WebPushVAPIDP8.
+	WebPushServer  *webPushServer
+	WebPushVAPIDP8 []byte
+)
+
+func init() {
+	var key *ecdsa.PrivateKey
+	key, WebPushVAPIDP8 = newTestP8()
+	ua, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	WebPushServer = &webPushServer{vapid: &key.PublicKey, ua: ua, auth: make([]byte, 16)}
+	rand.Read(WebPushServer.auth)
+	WebPushServer.Server = httptest.NewServer(http.HandlerFunc(WebPushServer.handle))
+}
+
+// reset forgets the messages received.
+func (s *webPushServer) reset() {
+	s.mu.Lock()
+	s.payloads = nil
+	s.headers = nil
+	s.mu.Unlock()
+}
+
+func (s *webPushServer) subscription(path string) *WebPushSubscription {
+	return &WebPushSubscription{
+		Endpoint: s.URL + path,
+		Keys: WebPushKeys{
+			P256DH: base64.RawURLEncoding.EncodeToString(s.ua.PublicKey().Bytes()),
+			Auth:   base64.RawURLEncoding.EncodeToString(s.auth),
+		},
+	}
+}
+
+func (s *webPushServer) handle(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkVAPID(r.Header.Get("Authorization")); err != nil {
+		w.WriteHeader(403)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if r.Header.Get("TTL") == "" {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "missing ttl")
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/gone/"):
+		w.WriteHeader(410)
+		return
+	case strings.HasPrefix(r.URL.Path, "/missing/"):
+		w.WriteHeader(404)
+		return
+	case strings.HasPrefix(r.URL.Path, "/busy/"):
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(429)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var payload []byte
+	if len(body) > 0 {
+		if r.Header.Get("Content-Encoding") != "aes128gcm" {
+			w.WriteHeader(415)
+			return
+		}
+		var err error
+		payload, err = webPushDecrypt(body, s.ua, s.auth)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, err)
+			return
+		}
+	}
+	s.mu.Lock()
+	s.payloads = append(s.payloads, payload)
+	s.headers = append(s.headers, r.Header)
+	s.mu.Unlock()
+	w.Header().Set("Location", s.URL+"/message/1")
+	w.WriteHeader(201)
+}
+
+func (s *webPushServer) checkVAPID(auth string) error {
+	if !strings.HasPrefix(auth, "vapid ") {
+		return fmt.Errorf("missing vapid")
+	}
+	params := map[string]string{}
+	for _, p := range strings.Split(strings.TrimPrefix(auth, "vapid "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		}
+	}
+	k, _ := s.vapid.ECDH()
+	if params["k"] != base64.RawURLEncoding.EncodeToString(k.Bytes()) {
+		return fmt.Errorf("unexpected k")
+	}
+	parts := strings.Split(params["t"], ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid jwt")
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if !verifyES256(s.vapid, []byte(parts[0]+"."+parts[1]), sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	claims := struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}{}
+	c, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(c, &claims)
+	if claims.Aud != s.URL || claims.Sub != "mailto:push@example.com" {
+		return fmt.Errorf("unexpected claims %+v", claims)
+	}
+	if exp := time.Unix(claims.Exp, 0); exp.Before(time.Now()) || exp.After(time.Now().Add(24*time.Hour)) {
+		return fmt.Errorf("unexpected exp %v", exp)
+	}
+	return nil
+}
+
+func TestWebPushSend(t *testing.T) {
+	WebPushServer.reset()
+	v, _ := NewWebPushVAPID("mailto:push@example.com", WebPushVAPIDP8)
+	c, err := NewWebPushClient(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &WebPushMessage{
+		Subscription: WebPushServer.subscription("/send/1"),
+		Payload:      []byte(`{"title":"hello"}`),
+		TTL:          3600,
+		Urgency:      WebPushUrgencyHigh,
+		Topic:        "greeting",
+	}
+	resp, err := c.Send(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 201 || resp.Location != WebPushServer.URL+"/message/1" || resp.Retry() != -1 || resp.UpdateToken() {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if string(WebPushServer.payloads[0]) != `{"title":"hello"}` {
+		t.Fatalf("unexpected payload %q", WebPushServer.payloads[0])
+	}
+	h := WebPushServer.headers[0]
+	if h.Get("TTL") != "3600" || h.Get("Urgency") != "high" || h.Get("Topic") != "greeting" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+
+	// Without a payload nothing is encrypted.
+	if _, err := c.Send(&WebPushMessage{Subscription: WebPushServer.subscription("/send/1")}); err != nil {
+		t.Fatal(err)
+	}
+	h = WebPushServer.headers[1]
+	if WebPushServer.payloads[1] != nil || h.Get("TTL") != "0" || h.Get("Content-Encoding") != "" || h.Get("Urgency") != "" {
+		t.Fatalf("unexpected request %v %q", h, WebPushServer.payloads[1])
+	}
+
+	// The vapid key is checked.
+	_, p8 := newTestP8()
+	other, _ := NewWebPushVAPID("mailto:push@example.com", p8)
+	c.VAPID = other
+	if _, err := c.Send(m); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected vapid rejected got %v", err)
+	}
+}
+
+func TestWebPushSendErrors(t *testing.T) {
+	v, _ := NewWebPushVAPID("mailto:push@example.com", WebPushVAPIDP8)
+	c, _ := NewWebPushClient(v)
+	store := NewMemoryTokenStore()
+	c.Tokens = store
+	paths := []string{"/send/1", "/gone/1", "/missing/1"}
+	for _, path := range paths {
+		store.Add(PlatformWebPush, WebPushServer.URL+path)
+	}
+
+	for _, path := range []string{"/gone/1", "/missing/1"} {
+		m := &WebPushMessage{Subscription: WebPushServer.subscription(path), Payload: []byte("a")}
+		resp, err := c.Send(m)
+		if err != ErrRemoveToken || !resp.UpdateToken() {
+			t.Fatalf("%s: expected ErrRemoveToken got %v", path, err)
+		}
+	}
+	for i, path := range paths {
+		if _, ok, _ := store.Lookup(PlatformWebPush, WebPushServer.URL+path); ok != (i == 0) {
+			t.Fatalf("%s: expected only unsubscribed endpoints removed", path)
+		}
+	}
+
+	resp, err := c.Send(&WebPushMessage{Subscription: WebPushServer.subscription("/busy/1")})
+	if err != ErrRetry || resp.Retry() != 7 {
+		t.Fatalf("expected retry after 7 got %v %d", err, resp.Retry())
+	}
+
+	if (*WebPushResponse)(nil).UpdateToken() {
+		t.Fatal("nil response updates no token")
+	}
+}